@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/dchest/blake2b"
 
@@ -25,8 +26,12 @@ func GetDir(bs *client.BlobStore, key, path string) (rr *ReadResult, err error)
 	meta.Hash = key
 	var crr *ReadResult
 	if meta.Size > 0 {
-		for _, hash := range meta.Refs {
-			meta, err := NewMetaFromBlobStore(bs, hash.(string))
+		for _, ref := range meta.Refs {
+			hash, ok := ref.(string)
+			if !ok {
+				return rr, fmt.Errorf("dir %v (%v): unexpected ref %v", meta.Name, meta.Hash, ref)
+			}
+			meta, err := NewMetaFromBlobStore(bs, hash)
 			if err != nil {
 				return nil, fmt.Errorf("failed to fetch meta: %v", err)
 			}
@@ -51,3 +56,59 @@ func GetDir(bs *client.BlobStore, key, path string) (rr *ReadResult, err error)
 	rr.Hash = fmt.Sprintf("%x", fullHash.Sum(nil))
 	return
 }
+
+// NotFoundError is returned by Lookup if the path doesn't exist.
+type NotFoundError struct {
+	Path string
+	// Set if a component of the path is a file
+	NotDir string
+}
+
+func (e *NotFoundError) Error() string {
+	if e.NotDir != "" {
+		return fmt.Sprintf("%v not found: %v is not a directory", e.Path, e.NotDir)
+	}
+	return fmt.Sprintf("%v not found", e.Path)
+}
+
+// Lookup returns the Meta of the file/directory located at path (slash separated,
+// relative to the directory referenced by key).
+func Lookup(bs *client.BlobStore, key, path string) (*Meta, error) {
+	meta, err := NewMetaFromBlobStore(bs, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch meta: %v", err)
+	}
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		if !meta.IsDir() {
+			return nil, &NotFoundError{Path: path, NotDir: meta.Name}
+		}
+		var child *Meta
+		for _, ref := range meta.Refs {
+			hash, ok := ref.(string)
+			if !ok {
+				return nil, fmt.Errorf("dir %v (%v): unexpected ref %v", meta.Name, meta.Hash, ref)
+			}
+			cmeta, err := NewMetaFromBlobStore(bs, hash)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch meta: %v", err)
+			}
+			if cmeta.Name == name {
+				child = cmeta
+				break
+			}
+		}
+		if child == nil {
+			return nil, &NotFoundError{Path: path}
+		}
+		meta = child
+	}
+	return meta, nil
+}
+
+// Restore restore the file or directory referenced by key to path.
+func Restore(bs *client.BlobStore, key, path string) (*ReadResult, error) {
+	return RestoreWithOptions(bs, key, path, nil)
+}
@@ -1,6 +1,7 @@
 package clientutil
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -10,9 +11,35 @@ import (
 	"sync"
 	"time"
 
-	gignore "github.com/sabhiram/go-git-ignore"
+	"golang.org/x/net/context"
 )
 
+// errChildFailed marks a directory that can't be uploaded because one of its children failed.
+var errChildFailed = errors.New("child upload failed")
+
+// FileError is the error returned when uploading a file/directory failed.
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Path, e.Err)
+}
+
+// FileErrors aggregates the errors that occurred during a PutDir or a restore,
+// every file is processed even if one of them failed.
+type FileErrors struct {
+	Errors []*FileError
+}
+
+func (e *FileErrors) Error() string {
+	if len(e.Errors) == 1 {
+		return e.Errors[0].Error()
+	}
+	return fmt.Sprintf("%v errors, first error: %v", len(e.Errors), e.Errors[0])
+}
+
 // node represents either a file or directory in the directory tree
 type node struct {
 	// root of the snapshot
@@ -34,6 +61,12 @@ type node struct {
 	meta *Meta
 	err  error
 
+	// Set if the file/directory has been skipped because it's unreadable or vanished
+	unreadable error
+
+	// Excluded children
+	excluded []*ExcludedPath
+
 	// Used to sync access to the WriteResult/Meta
 	mu   sync.Mutex
 	cond sync.Cond
@@ -44,28 +77,41 @@ func (node *node) String() string {
 }
 
 // Recursively read the directory and
-// send/route the files/directories to the according channel for processing
-func (up *Uploader) DirExplorer(path string, pnode *node, nodes chan<- *node) {
+// send/route the files/directories to the according channel for processing,
+// the exploration stops if the context is canceled.
+// rules are the exclude rules applied to the directory children.
+func (up *Uploader) dirExplorer(ctx context.Context, ex *excluder, path string, rules []*excludeRule, pnode *node, nodes chan<- *node) {
 	pnode.mu.Lock()
 	defer pnode.mu.Unlock()
 	dirdata, err := ioutil.ReadDir(path)
 	if err != nil {
+		if up.skippable(pnode, err) {
+			log.Printf("Uploader: skipping unreadable directory %v: %v", path, err)
+			pnode.unreadable = err
+		} else {
+			pnode.err = err
+		}
 		return
 	}
 	for _, fi := range dirdata {
-		abspath := filepath.Join(path, fi.Name())
-		relpath, err := filepath.Rel(up.Root, abspath)
-		if err != nil {
-			panic(err)
+		if ctx.Err() != nil {
+			return
 		}
-		if up.Ignorer != nil && up.Ignorer.MatchesPath(relpath) {
-			log.Printf("Uploader: %v excluded", relpath)
+		abspath := filepath.Join(path, fi.Name())
+		if reason := ex.excluded(abspath, fi, rules); reason != "" {
+			log.Printf("Uploader: %v excluded (%v)", abspath, reason)
+			pnode.excluded = append(pnode.excluded, ex.newExcludedPath(abspath, fi, reason, up.RecordExcluded))
 			continue
 		}
 		n := &node{path: abspath, fi: fi, parent: pnode}
 		n.cond.L = &n.mu
 		if fi.IsDir() {
-			up.DirExplorer(abspath, n, nodes)
+			crules, err := ex.dirRules(abspath, rules)
+			if err != nil {
+				n.err = err
+			} else {
+				up.dirExplorer(ctx, ex, abspath, crules, n, nodes)
+			}
 			nodes <- n
 			pnode.children = append(pnode.children, n)
 		} else {
@@ -79,12 +125,45 @@ func (up *Uploader) DirExplorer(path string, pnode *node, nodes chan<- *node) {
 	return
 }
 
+// skippable returns true if the error can be ignored by skipping the file/directory,
+// i.e. it's unreadable or has been removed since the directory was listed (never for the root).
+func (up *Uploader) skippable(node *node, err error) bool {
+	if up.Strict || node.root {
+		return false
+	}
+	return os.IsPermission(err) || os.IsNotExist(err)
+}
+
 // DirWriter reads the directory and upload it.
-func (up *Uploader) DirWriterNode(node *node) {
+func (up *Uploader) DirWriterNode(ctx context.Context, node *node) {
 	node.mu.Lock()
 	defer node.mu.Unlock()
+	// Always notify the parent, even on error
+	defer func() {
+		node.done = true
+		node.cond.Broadcast()
+	}()
 	node.wr = NewWriteResult()
 	hashes := []string{}
+	if node.err != nil {
+		return
+	}
+	for _, excluded := range node.excluded {
+		if excluded.Dir {
+			node.wr.DirsExcluded++
+		} else {
+			node.wr.FilesExcluded++
+		}
+		node.wr.SizeExcluded += excluded.Size
+	}
+	if up.RecordExcluded {
+		node.wr.Excluded = append(node.wr.Excluded, node.excluded...)
+	}
+	node.excluded = nil
+	if node.unreadable != nil {
+		// Like unreadable files, the directory is left out of its parent (instead of looking empty)
+		return
+	}
 
 	// Wait for all children node to finish
 	node.skipped = true
@@ -94,10 +173,22 @@ func (up *Uploader) DirWriterNode(node *node) {
 			cnode.cond.Wait()
 		}
 		if cnode.err != nil {
-			panic(cnode.err)
-			node.err = cnode.err
+			// The child error is already reported by PutDir
+			node.err = errChildFailed
+			cnode.mu.Unlock()
 			return
 		}
+		if cnode.unreadable != nil {
+			// The file/directory is left out of the directory
+			if cnode.fi.IsDir() {
+				node.wr.DirsUnreadable++
+			} else {
+				node.wr.FilesUnreadable++
+			}
+			node.wr.Errors = append(node.wr.Errors, fmt.Sprintf("%v: %v", cnode.path, cnode.unreadable))
+			cnode.mu.Unlock()
+			continue
+		}
 		node.skipped = node.skipped && cnode.skipped
 		node.wr.Add(cnode.wr)
 		cnode.wr.free()
@@ -107,14 +198,13 @@ func (up *Uploader) DirWriterNode(node *node) {
 		cnode.meta = nil
 		cnode.mu.Unlock()
 	}
+	if err := ctx.Err(); err != nil {
+		node.err = err
+		return
+	}
 	up.StartDirUpload()
 	defer up.DirUploadDone()
 
-	node.meta = NewMeta()
-	sort.Strings(hashes)
-	for _, hash := range hashes {
-		node.meta.AddRef(hash)
-	}
 	if node.skipped {
 		node.wr.DirsSkipped++
 	} else {
@@ -122,62 +212,145 @@ func (up *Uploader) DirWriterNode(node *node) {
 	}
 	node.wr.DirsCount++
 	// TODO WriteResult exisiting handling
-	node.meta.Name = filepath.Base(node.path)
-	node.meta.Type = "dir"
-	node.meta.Size = node.wr.Size
-	node.meta.Mode = uint32(node.fi.Mode())
-	node.meta.ModTime = node.fi.ModTime().Format(time.RFC3339)
-	mhash, mjs := node.meta.Json()
-	node.meta.Hash = mhash
+	node.meta, node.err = up.putDirMeta(filepath.Base(node.path), node.fi.Mode(), node.fi.ModTime(), hashes, node.wr)
+	return
+}
+
+// putDirMeta uploads the Meta of a directory containing the given children hashes
+// (if it doesn't exist yet), wr is the WriteResult of its content.
+func (up *Uploader) putDirMeta(name string, mode os.FileMode, mtime time.Time, hashes []string, wr *WriteResult) (*Meta, error) {
+	meta := NewMeta()
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		meta.AddRef(hash)
+	}
+	meta.Name = name
+	meta.Type = "dir"
+	meta.Size = wr.Size
+	meta.Mode = uint32(mode)
+	meta.ModTime = mtime.Format(time.RFC3339)
+	mhash, mjs, err := meta.Json()
+	if err != nil {
+		return nil, err
+	}
+	meta.Hash = mhash
 	mexists, err := up.bs.Stat(mhash)
 	if err != nil {
-		node.err = err
-		return
+		return nil, err
 	}
 	if !mexists {
 		if err := up.bs.Put(mhash, mjs); err != nil {
-			node.err = err
-			return
+			return nil, err
 		}
-		node.wr.BlobsCount++
-		node.wr.BlobsUploaded++
-		node.wr.SizeUploaded += len(mjs)
+		wr.BlobsCount++
+		wr.BlobsUploaded++
+		wr.SizeUploaded += len(mjs)
 	} else {
-		node.wr.SizeSkipped += len(mjs)
+		wr.SizeSkipped += len(mjs)
 	}
-	node.done = true
-	node.cond.Broadcast()
-	return
+	return meta, nil
+}
+
+// PutVirtualDir uploads a directory Meta that doesn't exist on the filesystem, containing the
+// given (already uploaded) metas, it's used to group several uploads in a single tree.
+// Its modification time is the most recent one of its children, so uploading the same metas twice
+// gives the same Meta.
+func (up *Uploader) PutVirtualDir(name string, metas []*Meta) (*Meta, *WriteResult, error) {
+	up.StartDirUpload()
+	defer up.DirUploadDone()
+	wr := NewWriteResult()
+	meta := NewMeta()
+	meta.Name = name
+	meta.Type = "dir"
+	meta.Mode = uint32(os.ModeDir | 0755)
+	hashes := []string{}
+	var mtime time.Time
+	for _, m := range metas {
+		hashes = append(hashes, m.Hash)
+		meta.Size += m.Size
+		if t, err := time.Parse(time.RFC3339, m.ModTime); err == nil && t.After(mtime) {
+			mtime = t
+		}
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		meta.AddRef(hash)
+	}
+	meta.ModTime = mtime.Format(time.RFC3339)
+	mhash, mjs, err := meta.Json()
+	if err != nil {
+		return nil, nil, err
+	}
+	meta.Hash = mhash
+	mexists, err := up.bs.Stat(mhash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to stat blob %v: %v", mhash, err)
+	}
+	wr.DirsCount++
+	wr.Size += len(mjs)
+	if !mexists {
+		if err := up.bs.Put(mhash, mjs); err != nil {
+			return nil, nil, fmt.Errorf("failed to put blob %v: %v", mhash, err)
+		}
+		wr.DirsUploaded++
+		wr.BlobsCount++
+		wr.BlobsUploaded++
+		wr.SizeUploaded += len(mjs)
+	} else {
+		wr.DirsSkipped++
+		wr.SizeSkipped += len(mjs)
+	}
+	return meta, wr, nil
 }
 
 // PutDir upload a directory, it returns the saved Meta,
 // a WriteResult containing infos about uploaded blobs.
 func (up *Uploader) PutDir(path string) (*Meta, *WriteResult, error) {
+	return up.PutDirContext(context.Background(), path)
+}
+
+// PutDirContext is like PutDir, but the upload is stopped if the context is canceled.
+func (up *Uploader) PutDirContext(ctx context.Context, path string) (*Meta, *WriteResult, error) {
 	//log.Printf("PutDir %v\n", path)
 	abspath, err := filepath.Abs(path)
 	if err != nil {
 		return nil, nil, err
 	}
-	up.Root = path
-	if _, err := os.Stat(filepath.Join(path, ".blobsnapignore")); err == nil {
-		ignorer, err := gignore.CompileIgnoreFile(filepath.Join(path, ".blobsnapignore"))
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to parse .blobsnapignore file: %v", err)
-		}
-		up.Ignorer = ignorer
-	}
 	nodes := make(chan *node)
-	fi, _ := os.Stat(abspath)
+	fi, err := os.Stat(abspath)
+	if err != nil {
+		return nil, nil, err
+	}
+	ex, err := newExcluder(abspath, fi, up.Excludes)
+	if err != nil {
+		return nil, nil, err
+	}
+	rules, err := ex.dirRules(abspath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
 	n := &node{root: true, path: abspath, fi: fi}
 	n.cond.L = &n.mu
 
+	// Errors are collected from the workers, and returned as a single FileErrors
+	var errsMu sync.Mutex
+	errs := &FileErrors{}
+	addErr := func(node *node) {
+		if node.err == errChildFailed || node.err == context.Canceled || node.err == context.DeadlineExceeded {
+			return
+		}
+		errsMu.Lock()
+		defer errsMu.Unlock()
+		errs.Errors = append(errs.Errors, &FileError{Path: node.path, Err: node.err})
+	}
+
 	var wg sync.WaitGroup
 	// Iterate the directory tree in a goroutine
 	// and dispatch node accordingly in the files/result channels.
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		up.DirExplorer(path, n, nodes)
+		up.dirExplorer(ctx, ex, abspath, rules, n, nodes)
 		defer close(nodes)
 	}()
 	// Upload discovered files (100 file descriptor at the same time max).
@@ -194,16 +367,26 @@ func (up *Uploader) PutDir(path string) (*Meta, *WriteResult, error) {
 				}()
 				defer wg.Done()
 				if node.fi.IsDir() {
-					up.DirWriterNode(node)
+					up.DirWriterNode(ctx, node)
 					if node.err != nil {
-						n.err = fmt.Errorf("error DirWriterNode with node %v", node)
+						addErr(node)
 					}
 				} else {
 					node.mu.Lock()
 					defer node.mu.Unlock()
-					node.meta, node.wr, node.err = up.PutFile(node.path)
+					node.meta, node.wr, node.err = up.PutFileContext(ctx, node.path)
+					if node.err != nil && up.skippable(node, node.err) {
+						log.Printf("Uploader: skipping unreadable file %v: %v", node.path, node.err)
+						node.unreadable, node.err = node.err, nil
+						node.done = true
+						node.cond.Broadcast()
+						return
+					}
 					if node.err != nil {
-						n.err = fmt.Errorf("error PutFile with node %v", node)
+						addErr(node)
+						node.done = true
+						node.cond.Broadcast()
+						return
 					}
 					if node.wr.FilesSkipped == 1 {
 						node.skipped = true
@@ -216,6 +399,15 @@ func (up *Uploader) PutDir(path string) (*Meta, *WriteResult, error) {
 	}()
 	wg.Wait()
 	// Upload the root directory
-	up.DirWriterNode(n)
-	return n.meta, n.wr, n.err
+	up.DirWriterNode(ctx, n)
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if n.err != nil {
+		addErr(n)
+	}
+	if len(errs.Errors) > 0 {
+		return nil, nil, errs
+	}
+	return n.meta, n.wr, nil
 }
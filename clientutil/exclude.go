@@ -0,0 +1,294 @@
+package clientutil
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	gignore "github.com/sabhiram/go-git-ignore"
+)
+
+// IgnoreFile is the name of the ignore files, read in every directory (like .gitignore files).
+const IgnoreFile = ".blobsnapignore"
+
+// cacheDirTagSignature is the header of CACHEDIR.TAG files (see http://www.brynosaurus.com/cachedir/).
+var cacheDirTagSignature = []byte("Signature: 8a477f597d28d172789f06886806bc55")
+
+// Excludes defines the files and directories left out of a directory upload,
+// in addition to the patterns of the .blobsnapignore files.
+type Excludes struct {
+	// Exclude/Include are gitignore-like patterns relative to the uploaded directory,
+	// included paths are never excluded by a pattern
+	Exclude []string `json:"exclude,omitempty"`
+	Include []string `json:"include,omitempty"`
+
+	// GitIgnore enables the .gitignore files
+	GitIgnore bool `json:"gitignore,omitempty"`
+
+	// ExcludeCaches excludes the directories containing a CACHEDIR.TAG file
+	ExcludeCaches bool `json:"exclude_caches,omitempty"`
+
+	// OneFileSystem excludes the directories located on another filesystem (i.e. mount points)
+	OneFileSystem bool `json:"one_file_system,omitempty"`
+}
+
+// excludeRule is a single pattern, relative to dir.
+type excludeRule struct {
+	// where the rule is defined, e.g. "/path/.blobsnapignore:3" or "--exclude"
+	source  string
+	dir     string
+	pattern string
+	negate  bool
+	ignorer *gignore.GitIgnore
+}
+
+func (r *excludeRule) String() string {
+	return fmt.Sprintf("%v: %v", r.source, r.pattern)
+}
+
+// matches returns true if the path (a directory if isDir is true) matches the pattern.
+func (r *excludeRule) matches(path string, isDir bool) bool {
+	rel, err := filepath.Rel(r.dir, path)
+	// Outside of the rule directory (but names like "..config" are fine)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	// Patterns with a trailing slash only match directories
+	if isDir && r.ignorer.MatchesPath(rel+"/") {
+		return true
+	}
+	return r.ignorer.MatchesPath(rel)
+}
+
+func newExcludeRule(source, dir, pattern string) (*excludeRule, error) {
+	rule := &excludeRule{source: source, dir: dir, pattern: pattern}
+	// Negated patterns are handled by the excluder (the last matching rule wins)
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	}
+	ignorer, err := gignore.CompileIgnoreLines(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %v: %v", rule, err)
+	}
+	rule.ignorer = ignorer
+	return rule, nil
+}
+
+// excluder decides which files/directories are excluded from a directory upload.
+type excluder struct {
+	opts *Excludes
+	// device of the root directory (for OneFileSystem)
+	dev uint64
+	// rules set from the options, applied before/after the ignore files rules
+	excludes []*excludeRule
+	includes []*excludeRule
+}
+
+func newExcluder(root string, fi os.FileInfo, opts *Excludes) (*excluder, error) {
+	if opts == nil {
+		opts = &Excludes{}
+	}
+	ex := &excluder{opts: opts, dev: device(fi)}
+	for _, pattern := range opts.Exclude {
+		rule, err := newExcludeRule("--exclude", root, pattern)
+		if err != nil {
+			return nil, err
+		}
+		ex.excludes = append(ex.excludes, rule)
+	}
+	for _, pattern := range opts.Include {
+		rule, err := newExcludeRule("--include", root, "!"+strings.TrimPrefix(pattern, "!"))
+		if err != nil {
+			return nil, err
+		}
+		ex.includes = append(ex.includes, rule)
+	}
+	return ex, nil
+}
+
+// dirRules returns the rules applied to the children of dir: the rules inherited
+// from its parent, followed by the rules of its own ignore files.
+func (ex *excluder) dirRules(dir string, parentRules []*excludeRule) ([]*excludeRule, error) {
+	names := []string{IgnoreFile}
+	if ex.opts.GitIgnore {
+		names = append(names, ".gitignore")
+	}
+	var rules []*excludeRule
+	for _, name := range names {
+		frules, err := loadIgnoreFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, frules...)
+	}
+	if len(rules) == 0 {
+		return parentRules, nil
+	}
+	return append(append([]*excludeRule{}, parentRules...), rules...), nil
+}
+
+// loadIgnoreFile parses an ignore file (if it exists), one rule per pattern.
+func loadIgnoreFile(path string) ([]*excludeRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read %v: %v", path, err)
+	}
+	var rules []*excludeRule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := newExcludeRule(fmt.Sprintf("%v:%d", path, i), filepath.Dir(path), line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// excluded returns the reason why the path is excluded (an empty string if it's not excluded),
+// rules are the rules of its parent directory.
+func (ex *excluder) excluded(path string, fi os.FileInfo, rules []*excludeRule) string {
+	isDir := fi.IsDir()
+	reason := ""
+	for _, set := range [][]*excludeRule{ex.excludes, rules, ex.includes} {
+		for _, rule := range set {
+			if rule.matches(path, isDir) {
+				if rule.negate {
+					reason = ""
+				} else {
+					reason = rule.String()
+				}
+			}
+		}
+	}
+	if reason != "" || !isDir {
+		return reason
+	}
+	if ex.opts.OneFileSystem && device(fi) != ex.dev {
+		return "--one-file-system: mount point"
+	}
+	if ex.opts.ExcludeCaches && isCacheDir(path) {
+		return "--exclude-caches: CACHEDIR.TAG"
+	}
+	return ""
+}
+
+// ExcludedPath is a file/directory excluded from an upload.
+type ExcludedPath struct {
+	Path string `json:"path"`
+	Dir  bool   `json:"dir,omitempty"`
+	// Size of the file, or of the directory content
+	Size int `json:"size"`
+	// Reason is the rule that excluded the path
+	Reason string `json:"reason"`
+}
+
+// newExcludedPath returns the excluded path, the size of a directory content is only computed
+// if dirSize is true (and never for mount points, they're not walked).
+func (ex *excluder) newExcludedPath(path string, fi os.FileInfo, reason string, dirSize bool) *ExcludedPath {
+	excluded := &ExcludedPath{Path: path, Dir: fi.IsDir(), Size: int(fi.Size()), Reason: reason}
+	if !excluded.Dir {
+		return excluded
+	}
+	excluded.Size = 0
+	dev := device(fi)
+	if !dirSize || dev != ex.dev {
+		return excluded
+	}
+	filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		// Stay on the filesystem of the directory
+		if fi.IsDir() && device(fi) != dev {
+			return filepath.SkipDir
+		}
+		if fi.Mode().IsRegular() {
+			excluded.Size += int(fi.Size())
+		}
+		return nil
+	})
+	return excluded
+}
+
+// ExplainExcludes walks the directory like PutDir (without uploading anything),
+// and returns the excluded paths along with the rule that excluded them.
+func ExplainExcludes(path string, opts *Excludes) ([]*ExcludedPath, error) {
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(abspath)
+	if err != nil {
+		return nil, err
+	}
+	ex, err := newExcluder(abspath, fi, opts)
+	if err != nil {
+		return nil, err
+	}
+	excludedPaths := []*ExcludedPath{}
+	var walk func(dir string, parentRules []*excludeRule) error
+	walk = func(dir string, parentRules []*excludeRule) error {
+		rules, err := ex.dirRules(dir, parentRules)
+		if err != nil {
+			return err
+		}
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			cpath := filepath.Join(dir, fi.Name())
+			if reason := ex.excluded(cpath, fi, rules); reason != "" {
+				excludedPaths = append(excludedPaths, ex.newExcludedPath(cpath, fi, reason, true))
+				continue
+			}
+			if fi.IsDir() {
+				if err := walk(cpath, rules); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(abspath, nil); err != nil {
+		return nil, err
+	}
+	return excludedPaths, nil
+}
+
+// isCacheDir returns true if the directory contains a valid CACHEDIR.TAG file.
+func isCacheDir(path string) bool {
+	f, err := os.Open(filepath.Join(path, "CACHEDIR.TAG"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, len(cacheDirTagSignature))
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+	return bytes.Equal(header, cacheDirTagSignature)
+}
+
+// device returns the ID of the device containing the file.
+func device(fi os.FileInfo) uint64 {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev)
+	}
+	return 0
+}
@@ -0,0 +1,175 @@
+package clientutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExcluder(t *testing.T) {
+	root, err := ioutil.TempDir("", "blobsnap-exclude-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	files := map[string]string{
+		".blobsnapignore":     "*.log\nbuild/\n",
+		"app.log":             "",
+		"..config.log":        "",
+		"keep.txt":            "",
+		"build/out":           "",
+		"sub/.blobsnapignore": "!important.log\n*.tmp\n",
+		"sub/important.log":   "",
+		"sub/other.log":       "",
+		"sub/file.tmp":        "",
+		"file.tmp":            "",
+		"sub/.gitignore":      "vendor\n",
+		"sub/vendor/lib":      "",
+		"cache/CACHEDIR.TAG":  string(cacheDirTagSignature) + "\n",
+		"secret/key":          "",
+		"secret/key.pub":      "",
+	}
+	for path, content := range files {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex, err := newExcluder(root, fi, &Excludes{
+		Exclude:       []string{"secret/"},
+		Include:       []string{"*.pub"},
+		GitIgnore:     true,
+		ExcludeCaches: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := ex.dirRules(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subRules, err := ex.dirRules(filepath.Join(root, "sub"), rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tdata := range []struct {
+		path     string
+		rules    []*excludeRule
+		excluded bool
+	}{
+		{"app.log", rules, true},
+		{"..config.log", rules, true},
+		{"keep.txt", rules, false},
+		{"build", rules, true},
+		{"file.tmp", rules, false},
+		{"sub", rules, false},
+		{"sub/important.log", subRules, false},
+		{"sub/other.log", subRules, true},
+		{"sub/file.tmp", subRules, true},
+		{"sub/vendor", subRules, true},
+		{"cache", rules, true},
+		{"secret", rules, true},
+		{"secret/key.pub", rules, false},
+	} {
+		path := filepath.Join(root, tdata.path)
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reason := ex.excluded(path, fi, tdata.rules)
+		if (reason != "") != tdata.excluded {
+			t.Errorf("%v: excluded=%v (reason %q), expected %v", tdata.path, reason != "", reason, tdata.excluded)
+		}
+	}
+}
+
+func TestExplainExcludes(t *testing.T) {
+	root, err := ioutil.TempDir("", "blobsnap-explain-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for path, content := range map[string]string{
+		".blobsnapignore": "*.log\n",
+		"app.log":         "12345",
+		"keep.txt":        "",
+		"tmp/a":           "123",
+		"tmp/b":           "45",
+	} {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	excluded, err := ExplainExcludes(root, &Excludes{Exclude: []string{"tmp"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]*ExcludedPath{
+		filepath.Join(root, "app.log"): {Size: 5, Reason: filepath.Join(root, IgnoreFile) + ":1: *.log"},
+		filepath.Join(root, "tmp"):     {Size: 5, Dir: true, Reason: "--exclude: tmp"},
+	}
+	if len(excluded) != len(expected) {
+		t.Fatalf("expected %d excluded paths, got %+v", len(expected), excluded)
+	}
+	for _, e := range excluded {
+		exp, ok := expected[e.Path]
+		if !ok {
+			t.Errorf("%v should not be excluded", e.Path)
+			continue
+		}
+		if e.Size != exp.Size || e.Dir != exp.Dir || e.Reason != exp.Reason {
+			t.Errorf("bad excluded path %+v, expected %+v", e, exp)
+		}
+	}
+}
+
+func TestExcludedPathSize(t *testing.T) {
+	root, err := ioutil.TempDir("", "blobsnap-excluded-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dir := filepath.Join(root, "node_modules")
+	if err := os.MkdirAll(filepath.Join(dir, "pkg"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "pkg", "index.js"), []byte("12345"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rootFi, err := os.Stat(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex, err := newExcluder(root, rootFi, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The directory is only walked when its size is needed
+	if e := ex.newExcludedPath(dir, fi, "test", false); e.Size != 0 || !e.Dir {
+		t.Errorf("directory should not be walked: %+v", e)
+	}
+	if e := ex.newExcludedPath(dir, fi, "test", true); e.Size != 5 {
+		t.Errorf("bad directory size: %+v", e)
+	}
+	// Mount points are never walked
+	ex.dev++
+	if e := ex.newExcludedPath(dir, fi, "test", true); e.Size != 0 {
+		t.Errorf("mount point should not be walked: %+v", e)
+	}
+}
@@ -0,0 +1,182 @@
+package clientutil
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/tsileo/blobstash/client/interface"
+)
+
+// Archive formats supported by Export.
+const (
+	FormatTar   = "tar"
+	FormatTarGz = "tar.gz"
+	FormatZip   = "zip"
+)
+
+// ArchiveFormat guesses the archive format from a file name, it defaults to tar.
+func ArchiveFormat(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return FormatZip
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return FormatTarGz
+	}
+	return FormatTar
+}
+
+// archiveWriter writes the entries of the archive.
+type archiveWriter interface {
+	// WriteEntry adds a file/directory (if r is nil) to the archive.
+	WriteEntry(name string, meta *Meta, mtime time.Time, r io.Reader) error
+	Close() error
+}
+
+type tarWriter struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (w *tarWriter) WriteEntry(name string, meta *Meta, mtime time.Time, r io.Reader) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(os.FileMode(meta.Mode).Perm()),
+		ModTime: mtime,
+	}
+	if r == nil {
+		hdr.Typeflag = tar.TypeDir
+	} else {
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(meta.Size)
+	}
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if r != nil {
+		if _, err := io.Copy(w.tw, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *tarWriter) Close() error {
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (w *zipWriter) WriteEntry(name string, meta *Meta, mtime time.Time, r io.Reader) error {
+	hdr := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	hdr.SetModTime(mtime)
+	mode := os.FileMode(meta.Mode).Perm()
+	if r == nil {
+		mode |= os.ModeDir
+		hdr.Method = zip.Store
+	}
+	hdr.SetMode(mode)
+	fw, err := w.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		if _, err := io.Copy(fw, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *zipWriter) Close() error {
+	return w.zw.Close()
+}
+
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case FormatTar:
+		return &tarWriter{tw: tar.NewWriter(w)}, nil
+	case FormatTarGz:
+		gz := gzip.NewWriter(w)
+		return &tarWriter{tw: tar.NewWriter(gz), gz: gz}, nil
+	case FormatZip:
+		return &zipWriter{zw: zip.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unsupported archive format %q (tar, tar.gz or zip)", format)
+}
+
+// Export writes the file/directory referenced by key to w as an archive (tar, tar.gz or zip),
+// the paths in the archive are prefixed with its name, and the content is read through FakeFile.
+func Export(bs client.BlobStorer, key string, w io.Writer, format string) (*ReadResult, error) {
+	aw, err := newArchiveWriter(w, format)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := NewMetaFromBlobStore(bs, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch meta: %v", err)
+	}
+	rr := &ReadResult{Hash: key}
+	if err := exportMeta(bs, aw, meta, meta.Name, rr); err != nil {
+		return rr, err
+	}
+	if err := aw.Close(); err != nil {
+		return rr, err
+	}
+	return rr, nil
+}
+
+func exportMeta(bs client.BlobStorer, aw archiveWriter, meta *Meta, name string, rr *ReadResult) error {
+	mtime, err := time.Parse(time.RFC3339, meta.ModTime)
+	if err != nil {
+		mtime = time.Now()
+	}
+	if meta.IsFile() {
+		ffile, err := NewFakeFile(bs, meta)
+		if err != nil {
+			return err
+		}
+		defer ffile.Close()
+		if err := aw.WriteEntry(name, meta, mtime, ffile); err != nil {
+			return fmt.Errorf("failed to export %v: %v", name, err)
+		}
+		rr.FilesCount++
+		rr.FilesDownloaded++
+		rr.Size += meta.Size
+		rr.SizeDownloaded += meta.Size
+		return nil
+	}
+	if err := aw.WriteEntry(name+"/", meta, mtime, nil); err != nil {
+		return fmt.Errorf("failed to export %v: %v", name, err)
+	}
+	rr.DirsCount++
+	rr.DirsDownloaded++
+	for _, ref := range meta.Refs {
+		hash, ok := ref.(string)
+		if !ok {
+			return fmt.Errorf("dir %v (%v): unexpected ref %v", meta.Name, meta.Hash, ref)
+		}
+		cmeta, err := NewMetaFromBlobStore(bs, hash)
+		if err != nil {
+			return fmt.Errorf("failed to fetch meta: %v", err)
+		}
+		if err := exportMeta(bs, aw, cmeta, path.Join(name, cmeta.Name), rr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package clientutil
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestArchiveFormat(t *testing.T) {
+	for name, format := range map[string]string{
+		"":                FormatTar,
+		"backup.tar":      FormatTar,
+		"backup.tar.gz":   FormatTarGz,
+		"backup.tgz":      FormatTarGz,
+		"backup.zip":      FormatZip,
+		"backup.whatever": FormatTar,
+	} {
+		if f := ArchiveFormat(name); f != format {
+			t.Errorf("%q: format %v, expected %v", name, f, format)
+		}
+	}
+}
+
+func TestExportFile(t *testing.T) {
+	// A file made of holes can be read without a blob store
+	// (zip timestamps have a 2 seconds resolution)
+	mtime := time.Date(2015, 5, 12, 17, 25, 46, 0, time.UTC)
+	meta := &Meta{Name: "disk.img", Type: "file", Size: 1000, Mode: 0640, ModTime: mtime.Format(time.RFC3339)}
+	meta.AddHole(1000)
+	for _, format := range []string{FormatTar, FormatTarGz, FormatZip} {
+		var buf bytes.Buffer
+		aw, err := newArchiveWriter(&buf, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := &ReadResult{}
+		if err := exportMeta(nil, aw, meta, meta.Name, rr); err != nil {
+			t.Fatal(err)
+		}
+		if err := aw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if rr.FilesCount != 1 || rr.Size != 1000 {
+			t.Errorf("%v: unexpected read result %+v", format, rr)
+		}
+		var name string
+		var mode int64
+		var modTime time.Time
+		var r io.Reader
+		switch format {
+		case FormatZip:
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(zr.File) != 1 {
+				t.Fatalf("%v: expected 1 file, got %d", format, len(zr.File))
+			}
+			f := zr.File[0]
+			name, mode, modTime = f.Name, int64(f.Mode().Perm()), f.ModTime()
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+			r = rc
+		default:
+			r = &buf
+			if format == FormatTarGz {
+				gz, err := gzip.NewReader(&buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r = gz
+			}
+			tr := tar.NewReader(r)
+			hdr, err := tr.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			name, mode, modTime = hdr.Name, hdr.Mode, hdr.ModTime
+			r = tr
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != "disk.img" || mode != 0640 || !modTime.Equal(mtime) {
+			t.Errorf("%v: unexpected entry %v %o %v", format, name, mode, modTime)
+		}
+		if !bytes.Equal(data, make([]byte, 1000)) {
+			t.Errorf("%v: unexpected content (%d bytes)", format, len(data))
+		}
+	}
+	if _, err := newArchiveWriter(ioutil.Discard, "rar"); err == nil {
+		t.Errorf("unsupported format should be rejected")
+	}
+}
@@ -27,10 +27,15 @@ func GetFile(bs client.BlobStorer, key, path string) (*ReadResult, error) {
 		return nil, fmt.Errorf("failed to get meta %v: %v", key, err)
 	}
 	meta.Hash = key
-	ffile := NewFakeFile(bs, meta)
+	ffile, err := NewFakeFile(bs, meta)
+	if err != nil {
+		return nil, err
+	}
 	defer ffile.Close()
 	fileReader := io.TeeReader(ffile, h)
-	io.Copy(buf, fileReader)
+	if _, err := io.Copy(buf, fileReader); err != nil {
+		return nil, fmt.Errorf("failed to restore %v: %v", path, err)
+	}
 	readResult.Hash = fmt.Sprintf("%x", h.Sum(nil))
 	readResult.FilesCount++
 	readResult.FilesDownloaded++
@@ -72,14 +77,15 @@ type FakeFile struct {
 	lru     *lru.Cache
 }
 
-// NewFakeFile creates a new FakeFile instance.
-func NewFakeFile(bs client.BlobStorer, meta *Meta) (f *FakeFile) {
+// NewFakeFile creates a new FakeFile instance,
+// it returns an error if the refs of the Meta are malformed.
+func NewFakeFile(bs client.BlobStorer, meta *Meta) (*FakeFile, error) {
 	// Needed for the blob routing
 	cache, err := lru.New(2)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	f = &FakeFile{
+	f := &FakeFile{
 		bs:      bs,
 		meta:    meta,
 		size:    meta.Size,
@@ -89,7 +95,10 @@ func NewFakeFile(bs client.BlobStorer, meta *Meta) (f *FakeFile) {
 	}
 	if meta.Size > 0 {
 		for idx, m := range meta.Refs {
-			data := m.([]interface{})
+			data, ok := m.([]interface{})
+			if !ok || len(data) != 2 {
+				return nil, fmt.Errorf("file %v (%v): unexpected ref %v", meta.Name, meta.Hash, m)
+			}
 			var index int
 			switch i := data[0].(type) {
 			case float64:
@@ -97,14 +106,28 @@ func NewFakeFile(bs client.BlobStorer, meta *Meta) (f *FakeFile) {
 			case int:
 				index = i
 			default:
-				panic("unexpected index")
+				return nil, fmt.Errorf("file %v (%v): unexpected index %v", meta.Name, meta.Hash, data[0])
 			}
-			iv := &IndexValue{Index: index, Value: data[1].(string), I: idx}
+			hash, ok := data[1].(string)
+			if !ok {
+				return nil, fmt.Errorf("file %v (%v): unexpected hash %v", meta.Name, meta.Hash, data[1])
+			}
+			iv := &IndexValue{Index: index, Value: hash, I: idx}
 			f.lmrange = append(f.lmrange, iv)
 			f.trie.Insert(iv)
 		}
 	}
-	return
+	return f, nil
+}
+
+// sparse returns true if the file contains holes.
+func (f *FakeFile) sparse() bool {
+	for _, iv := range f.lmrange {
+		if iv.Value == "" {
+			return true
+		}
+	}
+	return false
 }
 
 func (f *FakeFile) Close() error {
@@ -116,14 +139,24 @@ func (f *FakeFile) ReadAt(p []byte, offset int64) (n int, err error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
-	if f.size == 0 || f.offset >= f.size {
+	if offset < 0 {
+		return 0, fmt.Errorf("FakeFile %v: negative offset %v", f.meta.Hash, offset)
+	}
+	if offset >= int64(f.size) {
 		return 0, io.EOF
 	}
-	buf, err := f.read(int(offset), len(p))
+	cnt := len(p)
+	if int64(cnt) > int64(f.size)-offset {
+		cnt = int(int64(f.size) - offset)
+	}
+	buf, err := f.read(int(offset), cnt)
 	if err != nil {
 		return
 	}
 	n = copy(p, buf)
+	if n < len(p) {
+		err = io.EOF
+	}
 	return
 }
 
@@ -140,17 +173,42 @@ func (f *FakeFile) read(offset, cnt int) ([]byte, error) {
 	written := 0
 
 	if len(f.lmrange) == 0 {
-		panic(fmt.Errorf("FakeFile %+v lmrange empty", f))
+		return nil, fmt.Errorf("FakeFile %v has no refs", f.meta.Hash)
 	}
 
-	tiv := f.trie.Successor(uint64(offset)).(*IndexValue)
-	if tiv.Index == offset {
-		tiv = f.trie.Successor(uint64(offset + 1)).(*IndexValue)
+	tiv, ok := f.trie.Successor(uint64(offset)).(*IndexValue)
+	if ok && tiv.Index == offset {
+		tiv, ok = f.trie.Successor(uint64(offset + 1)).(*IndexValue)
+	}
+	if !ok {
+		return nil, fmt.Errorf("FakeFile %v: no blob found for offset %v", f.meta.Hash, offset)
 	}
 	for _, iv := range f.lmrange[tiv.I:] {
 		if offset > iv.Index {
 			continue
 		}
+		if iv.Value == "" {
+			// Holes are not stored, they're read as zeros
+			blobStart := 0
+			if iv.I > 0 {
+				blobStart = f.lmrange[iv.I-1].Index
+			}
+			foffset := 0
+			if offset != 0 {
+				foffset = offset - blobStart
+				offset = 0
+			}
+			n := iv.Index - blobStart - foffset
+			if n > cnt-written {
+				n = cnt - written
+			}
+			buf.Write(make([]byte, n))
+			written += n
+			if written == cnt {
+				return buf.Bytes(), nil
+			}
+			continue
+		}
 		//bbuf, _, _ := f.client.Blobs.Get(iv.Value)
 		if cached, ok := f.lru.Get(iv.Value); ok {
 			cbuf = cached.([]byte)
@@ -183,8 +241,8 @@ func (f *FakeFile) read(offset, cnt int) ([]byte, error) {
 		} else {
 			// What we need fit in this blob
 			// it should return after this
-			if foffset+cnt-written > len(bbuf) {
-				panic(fmt.Errorf("failed to read from FakeFile %+v [%v:%v]", f, foffset, foffset+cnt-written))
+			if foffset < 0 || foffset+cnt-written > len(bbuf) {
+				return nil, fmt.Errorf("failed to read from FakeFile %v [%v:%v]", f.meta.Hash, foffset, foffset+cnt-written)
 			}
 			fwritten, err := buf.Write(bbuf[foffset : foffset+cnt-written])
 			if err != nil {
@@ -194,7 +252,7 @@ func (f *FakeFile) read(offset, cnt int) ([]byte, error) {
 			written += fwritten
 			// Check that the total written bytes equals the requested size
 			if written != cnt {
-				panic("error reading FakeFile")
+				return nil, fmt.Errorf("failed to read from FakeFile %v: %v/%v bytes read", f.meta.Hash, written, cnt)
 			}
 		}
 		if written == cnt {
@@ -231,7 +289,7 @@ func (f *FakeFile) Read(p []byte) (n int, err error) {
 		return 0, io.EOF
 	}
 	if err != nil {
-		return 0, fmt.Errorf("failed to read %+v at range %v-%v", f, f.offset, limit)
+		return 0, fmt.Errorf("failed to read %v at range %v-%v: %v", f.meta.Hash, f.offset, limit, err)
 	}
 	n = copy(p, b)
 	f.offset += n
@@ -0,0 +1,87 @@
+package clientutil
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestNewFakeFileMalformedRefs(t *testing.T) {
+	for _, refs := range [][]interface{}{
+		{"notanindexedref"},
+		{[]interface{}{"1", "hash"}},
+		{[]interface{}{float64(1), 2}},
+		{[]interface{}{float64(1)}},
+	} {
+		meta := &Meta{Name: "file", Type: "file", Size: 1, Refs: refs}
+		if _, err := NewFakeFile(nil, meta); err == nil {
+			t.Errorf("refs %v should be rejected", refs)
+		}
+	}
+	meta := &Meta{Name: "file", Type: "file", Size: 1, Refs: []interface{}{[]interface{}{float64(1), "hash"}}}
+	if _, err := NewFakeFile(nil, meta); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestFakeFileHoles(t *testing.T) {
+	// Holes are read as zeros, without fetching anything
+	meta := &Meta{Name: "file", Type: "file", Size: 300}
+	meta.AddHole(100)
+	meta.AddHole(300)
+	ffile, err := NewFakeFile(nil, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, offset := range []int64{0, 50, 100, 150} {
+		p := make([]byte, 120)
+		n, err := ffile.ReadAt(p, offset)
+		if err != nil {
+			t.Fatalf("ReadAt(%d): %v", offset, err)
+		}
+		if n != len(p) || !bytes.Equal(p, make([]byte, len(p))) {
+			t.Errorf("ReadAt(%d): unexpected data (%d bytes) %v", offset, n, p)
+		}
+	}
+	data, err := ioutil.ReadAll(ffile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 300 || !bytes.Equal(data, make([]byte, 300)) {
+		t.Errorf("unexpected content (%d bytes)", len(data))
+	}
+}
+
+func TestFakeFileReadAtEOF(t *testing.T) {
+	meta := &Meta{Name: "file", Type: "file", Size: 300}
+	meta.AddHole(300)
+	ffile, err := NewFakeFile(nil, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ReadAt doesn't depend on the Read offset
+	if _, err := ioutil.ReadAll(ffile); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		offset int64
+		n      int
+		err    error
+	}{
+		{0, 100, nil},
+		{200, 100, nil},
+		{250, 50, io.EOF},
+		{300, 0, io.EOF},
+		{1000, 0, io.EOF},
+	} {
+		p := make([]byte, 100)
+		n, err := ffile.ReadAt(p, tc.offset)
+		if n != tc.n || err != tc.err {
+			t.Errorf("ReadAt(%d): got (%d, %v), expected (%d, %v)", tc.offset, n, err, tc.n, tc.err)
+		}
+	}
+	if _, err := ffile.ReadAt(make([]byte, 10), -1); err == nil {
+		t.Errorf("ReadAt(-1) should fail")
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"time"
 
 	"github.com/dchest/blake2b"
+	"golang.org/x/net/context"
 
 	"github.com/tsileo/blobsnap/chunker"
 )
@@ -18,62 +20,164 @@ var (
 	MaxBlobSize = 1 << 20  // 1MB
 )
 
-func (up *Uploader) writeReader(f io.Reader, meta *Meta) (*WriteResult, error) {
-	writeResult := NewWriteResult()
+const (
+	// Zeros are detected by blocks (aligned on the start of the file)
+	holeBlockSize = 4096
+	// Smaller regions of zeros are stored as data
+	holeMinSize = 64 << 10
+)
+
+var zeroBlock = make([]byte, holeBlockSize)
+
+// splitReader splits the reader into blobs, and calls fn with the hash, the data and the end
+// offset of each blob, it returns the hash of the whole content. If sparse is true, the regions
+// of zeros (at least holeMinSize bytes) are not split into blobs, fn is called with an empty hash
+// and no data for each of them. It stops (and returns ctx.Err()) if the context is canceled.
+func splitReader(ctx context.Context, f io.Reader, sparse bool, fn func(hash string, data []byte, index int) error) (string, error) {
 	// Init the rolling checksum
 	rs := chunker.New()
 	// Prepare the reader to compute the hash on the fly
 	fullHash := blake2b.New256()
 	freader := io.TeeReader(f, fullHash)
-	eof := false
 	i := 0
-	// TODO don't read one byte at a time if meta.Size < chunker.ChunkMinSize
 	// Prepare the blob writer
 	var buf bytes.Buffer
 	blobHash := blake2b.New256()
 	blobWriter := io.MultiWriter(&buf, blobHash, rs)
-	for {
-		b := make([]byte, 1)
-		_, err := freader.Read(b)
-		if err == io.EOF {
-			eof = true
-		} else {
-			blobWriter.Write(b)
+	// Set if the last ref is a hole
+	hole := false
+	flush := func() error {
+		nsha := fmt.Sprintf("%x", blobHash.Sum(nil))
+		if err := fn(nsha, buf.Bytes(), i); err != nil {
+			return err
+		}
+		buf.Reset()
+		blobHash.Reset()
+		rs.Reset()
+		return nil
+	}
+	// The data is written byte by byte to split it at the rolling checksum boundaries
+	write := func(data []byte) error {
+		for j := range data {
+			blobWriter.Write(data[j : j+1])
 			i++
+			hole = false
+			onSplit := rs.OnSplit()
+			// Check the context at each blob boundary, and every 64KB
+			if onSplit || i%(64<<10) == 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+			}
+			//if (onSplit && (buf.Len() > MinBlobSize)) || buf.Len() >= MaxBlobSize {
+			if onSplit {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	// Pending zeros, written as a hole, or as data if the region is too small
+	zeros := 0
+	writeZeros := func() error {
+		n := zeros
+		zeros = 0
+		if n < holeMinSize {
+			for ; n > 0; n -= holeBlockSize {
+				if err := write(zeroBlock); err != nil {
+					return err
+				}
+			}
+			return nil
 		}
-		onSplit := rs.OnSplit()
-		//if (onSplit && (buf.Len() > MinBlobSize)) || buf.Len() >= MaxBlobSize || eof {
-		if onSplit || eof {
-			nsha := fmt.Sprintf("%x", blobHash.Sum(nil))
-			// Check if the blob exists
-			exists, err := up.bs.Stat(nsha)
-			if err != nil {
-				panic(fmt.Sprintf("DB error: %v", err))
+		if buf.Len() > 0 {
+			if err := flush(); err != nil {
+				return err
 			}
-			if !exists {
-				if err := up.bs.Put(nsha, buf.Bytes()); err != nil {
-					panic(fmt.Errorf("failed to PUT blob %v", err))
+		}
+		i += n
+		hole = true
+		rs.Reset()
+		return fn("", nil, i)
+	}
+	block := make([]byte, holeBlockSize)
+	for {
+		n, err := io.ReadFull(freader, block)
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			return "", fmt.Errorf("failed to read: %v", err)
+		}
+		if sparse && n == holeBlockSize && bytes.Equal(block, zeroBlock) {
+			zeros += n
+		} else {
+			if zeros > 0 {
+				if err := writeZeros(); err != nil {
+					return "", err
 				}
-				writeResult.BlobsUploaded++
-				writeResult.SizeUploaded += buf.Len()
-			} else {
-				writeResult.SizeSkipped += buf.Len()
-				writeResult.BlobsSkipped++
 			}
-			writeResult.Size += buf.Len()
-			buf.Reset()
-			blobHash.Reset()
-			writeResult.BlobsCount++
-			// Save the location and the blob hash into a sorted list (with the offset as index)
-			meta.AddIndexedRef(writeResult.Size, nsha)
-			//tx.Ladd(key, writeResult.Size, nsha)
-			rs.Reset()
+			if err := write(block[:n]); err != nil {
+				return "", err
+			}
 		}
 		if eof {
 			break
 		}
 	}
-	writeResult.Hash = fmt.Sprintf("%x", fullHash.Sum(nil))
+	if zeros > 0 {
+		if err := writeZeros(); err != nil {
+			return "", err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	// The last blob (unless the file ends with a hole)
+	if !hole || buf.Len() > 0 {
+		if err := flush(); err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", fullHash.Sum(nil)), nil
+}
+
+// writeReader splits the reader into blobs and uploads them, the upload is stopped
+// (and ctx.Err() returned) if the context is canceled.
+func (up *Uploader) writeReader(ctx context.Context, f io.Reader, meta *Meta) (*WriteResult, error) {
+	writeResult := NewWriteResult()
+	hash, err := splitReader(ctx, f, up.Sparse, func(nsha string, data []byte, index int) error {
+		if nsha == "" {
+			holeSize := index - writeResult.Size
+			writeResult.Size += holeSize
+			writeResult.SizeSparse += holeSize
+			meta.AddHole(index)
+			return nil
+		}
+		// Check if the blob exists
+		exists, err := up.bs.Stat(nsha)
+		if err != nil {
+			return fmt.Errorf("failed to stat blob %v: %v", nsha, err)
+		}
+		if !exists {
+			if err := up.bs.Put(nsha, data); err != nil {
+				return fmt.Errorf("failed to put blob %v: %v", nsha, err)
+			}
+			writeResult.BlobsUploaded++
+			writeResult.SizeUploaded += len(data)
+		} else {
+			writeResult.SizeSkipped += len(data)
+			writeResult.BlobsSkipped++
+		}
+		writeResult.Size += len(data)
+		writeResult.BlobsCount++
+		// Save the location and the blob hash into a sorted list (with the offset as index)
+		meta.AddIndexedRef(writeResult.Size, nsha)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeResult.Hash = hash
 	if writeResult.BlobsUploaded > 0 {
 		writeResult.FilesCount++
 		writeResult.FilesUploaded++
@@ -82,11 +186,47 @@ func (up *Uploader) writeReader(f io.Reader, meta *Meta) (*WriteResult, error) {
 }
 
 func (up *Uploader) PutFile(path string) (*Meta, *WriteResult, error) {
+	return up.PutFileContext(context.Background(), path)
+}
+
+// PutFileContext is like PutFile, but the upload is stopped if the context is canceled.
+//
+// If the file is modified while being uploaded, the upload is retried (up to ChangedRetries times),
+// and if it's still changing, the content read is kept and the file is reported as inconsistent
+// in the WriteResult.
+func (up *Uploader) PutFileContext(ctx context.Context, path string) (*Meta, *WriteResult, error) {
 	up.StartUpload()
 	defer up.UploadDone()
+	for attempt := 0; ; attempt++ {
+		meta, wr, changed, err := up.putFile(ctx, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if changed && attempt >= up.ChangedRetries {
+			log.Printf("Uploader: %v is still changing, marked as inconsistent", path)
+			wr.FilesInconsistent++
+			wr.Inconsistent = append(wr.Inconsistent, path)
+			changed = false
+		}
+		// The Meta is only uploaded for the last attempt
+		if !changed {
+			if err := up.putMeta(meta, wr); err != nil {
+				return nil, nil, err
+			}
+			return meta, wr, nil
+		}
+		log.Printf("Uploader: %v changed during upload, retrying", path)
+		meta.free()
+		wr.free()
+	}
+}
+
+// putFile uploads the file content (its Meta is uploaded by the caller), and reports if
+// it has been modified while being read (i.e. the size/mtime changed, or the size read doesn't match).
+func (up *Uploader) putFile(ctx context.Context, path string) (*Meta, *WriteResult, bool, error) {
 	fstat, err := os.Stat(path)
-	if os.IsNotExist(err) {
-		return nil, nil, err
+	if err != nil {
+		return nil, nil, false, err
 	}
 	_, filename := filepath.Split(path)
 	//sha, err := FullHash(path)
@@ -102,26 +242,44 @@ func (up *Uploader) PutFile(path string) (*Meta, *WriteResult, error) {
 	wr := NewWriteResult()
 	if fstat.Size() > 0 {
 		f, err := os.Open(path)
-		defer f.Close()
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, false, err
+		}
+		defer f.Close()
+		cwr, err := up.writeReader(ctx, f, meta)
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return nil, nil, false, err
 		}
-		cwr, err := up.writeReader(f, meta)
 		if err != nil {
-			return nil, nil, fmt.Errorf("FileWriter error: %v", err)
+			return nil, nil, false, fmt.Errorf("FileWriter error: %v", err)
 		}
 		wr.free()
 		wr = cwr
+		// The Meta must match the content actually uploaded
+		meta.Size = wr.Size
+	}
+	fstat2, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	changed := fstat2.Size() != fstat.Size() || !fstat2.ModTime().Equal(fstat.ModTime()) || meta.Size != int(fstat.Size())
+	return meta, wr, changed, nil
+}
+
+// putMeta uploads the Meta of a file (if it doesn't exist yet) and sets its hash.
+func (up *Uploader) putMeta(meta *Meta, wr *WriteResult) error {
+	mhash, mjs, err := meta.Json()
+	if err != nil {
+		return err
 	}
-	mhash, mjs := meta.Json()
 	mexists, err := up.bs.Stat(mhash)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to stat blob %v: %v", mhash, err)
+		return fmt.Errorf("failed to stat blob %v: %v", mhash, err)
 	}
 	wr.Size += len(mjs)
 	if !mexists {
 		if err := up.bs.Put(mhash, mjs); err != nil {
-			return nil, nil, fmt.Errorf("failed to put blob %v: %v", mhash, err)
+			return fmt.Errorf("failed to put blob %v: %v", mhash, err)
 		}
 		wr.BlobsCount++
 		wr.BlobsUploaded++
@@ -130,11 +288,16 @@ func (up *Uploader) PutFile(path string) (*Meta, *WriteResult, error) {
 		wr.SizeSkipped += len(mjs)
 	}
 	meta.Hash = mhash
-	return meta, wr, nil
+	return nil
 }
 
-// fmt.Sprintf("%x", blake2b.Sum256(js))
+// PutReader uploads the content of the reader as a file named name.
 func (up *Uploader) PutReader(name string, reader io.ReadCloser) (*Meta, *WriteResult, error) {
+	return up.PutReaderContext(context.Background(), name, reader)
+}
+
+// PutReaderContext is like PutReader, but the upload is stopped if the context is canceled.
+func (up *Uploader) PutReaderContext(ctx context.Context, name string, reader io.ReadCloser) (*Meta, *WriteResult, error) {
 	up.StartUpload()
 	defer up.UploadDone()
 
@@ -144,29 +307,18 @@ func (up *Uploader) PutReader(name string, reader io.ReadCloser) (*Meta, *WriteR
 	meta.ModTime = time.Now().Format(time.RFC3339)
 	meta.Mode = uint32(0666)
 	wr := NewWriteResult()
-	cwr, err := up.writeReader(reader, meta)
+	cwr, err := up.writeReader(ctx, reader, meta)
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return nil, nil, err
+	}
 	if err != nil {
 		return nil, nil, fmt.Errorf("FileWriter error: %v", err)
 	}
 	meta.Size = cwr.Size
 	wr.free()
 	wr = cwr
-	mhash, mjs := meta.Json()
-	mexists, err := up.bs.Stat(mhash)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to stat blob %v: %v", mhash, err)
-	}
-	wr.Size += len(mjs)
-	if !mexists {
-		if err := up.bs.Put(mhash, mjs); err != nil {
-			return nil, nil, fmt.Errorf("failed to put blob %v: %v", mhash, err)
-		}
-		wr.BlobsCount++
-		wr.BlobsUploaded++
-		wr.SizeUploaded += len(mjs)
-	} else {
-		wr.SizeSkipped += len(mjs)
+	if err := up.putMeta(meta, wr); err != nil {
+		return nil, nil, err
 	}
-	meta.Hash = mhash
 	return meta, wr, nil
 }
@@ -0,0 +1,79 @@
+package clientutil
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestSplitReaderSparse(t *testing.T) {
+	data := bytes.Repeat([]byte("blobsnap"), 1<<10)
+	var content []byte
+	content = append(content, data...)
+	// A region of zeros large enough to be a hole, aligned on the hole blocks
+	holeStart := (len(content)/holeBlockSize + 1) * holeBlockSize
+	content = append(content, make([]byte, holeStart-len(content)+holeMinSize)...)
+	content = append(content, data...)
+	// Too small to be a hole
+	content = append(content, make([]byte, holeMinSize/2)...)
+	content = append(content, data...)
+	// Trailing hole
+	content = append(content, make([]byte, 2*holeMinSize)...)
+
+	type ref struct {
+		hash  string
+		index int
+	}
+	split := func(sparse bool) ([]*ref, []byte) {
+		refs := []*ref{}
+		var out []byte
+		if _, err := splitReader(context.Background(), bytes.NewReader(content), sparse, func(hash string, blob []byte, index int) error {
+			if hash == "" {
+				out = append(out, make([]byte, index-len(out))...)
+			} else {
+				out = append(out, blob...)
+			}
+			if len(out) != index {
+				t.Errorf("bad index %d, expected %d", index, len(out))
+			}
+			refs = append(refs, &ref{hash, index})
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return refs, out
+	}
+	refs, out := split(true)
+	if !bytes.Equal(out, content) {
+		t.Errorf("sparse split doesn't match the content")
+	}
+	holes := []int{}
+	for _, r := range refs {
+		if r.hash == "" {
+			holes = append(holes, r.index)
+		}
+	}
+	if len(holes) != 2 || holes[0] != holeStart+holeMinSize || holes[1] != len(content) {
+		t.Errorf("unexpected holes %v", holes)
+	}
+	if last := refs[len(refs)-1]; last.hash != "" {
+		t.Errorf("the file should end with a hole, got %+v", last)
+	}
+	if _, out := split(false); !bytes.Equal(out, content) {
+		t.Errorf("split doesn't match the content")
+	}
+
+	// Without any hole, the refs are the same
+	content = bytes.Repeat(data, 100)
+	sparseRefs, _ := split(true)
+	refs, _ = split(false)
+	if len(refs) != len(sparseRefs) {
+		t.Fatalf("got %d refs, expected %d", len(sparseRefs), len(refs))
+	}
+	for i := range refs {
+		if *refs[i] != *sparseRefs[i] {
+			t.Errorf("ref %d: %+v, expected %+v", i, sparseRefs[i], refs[i])
+		}
+	}
+}
@@ -45,19 +45,26 @@ func (m *Meta) free() {
 	metaPool.Put(m)
 }
 
-func (m *Meta) Json() (string, []byte) {
+// Json returns the hash and the JSON encoded Meta.
+func (m *Meta) Json() (string, []byte, error) {
 	js, err := json.Marshal(m)
 	if err != nil {
-		panic(err)
+		return "", nil, fmt.Errorf("failed to encode meta %v: %v", m.Name, err)
 	}
 	h := fmt.Sprintf("%x", blake2b.Sum256(js))
-	return h, js
+	return h, js, nil
 }
 
 func (m *Meta) AddIndexedRef(index int, hash string) {
 	m.Refs = append(m.Refs, []interface{}{index, hash})
 }
 
+// AddHole adds a hole (a region of zeros, not stored in a blob) ending at index,
+// holes are indexed refs with an empty hash.
+func (m *Meta) AddHole(index int) {
+	m.AddIndexedRef(index, "")
+}
+
 func (m *Meta) AddRef(hash string) {
 	m.Refs = append(m.Refs, hash)
 }
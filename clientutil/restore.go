@@ -0,0 +1,627 @@
+package clientutil
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/blake2b"
+	"golang.org/x/net/context"
+
+	"github.com/tsileo/blobstash/client/interface"
+)
+
+var (
+	restoreFiles  = 25 // concurrent file downloads
+	restoreDirs   = 12 // concurrent meta fetches
+	prefetchBlobs = 4  // blobs fetched ahead of the one being written, for each file
+)
+
+// RestoreOptions selects the files/directories restored by RestoreWithOptions.
+type RestoreOptions struct {
+	// Include/Exclude are glob patterns (path.Match syntax, "**" matches any number of directories)
+	// matched against the slash separated path relative to the snapshot root, a pattern matching
+	// a directory also matches its content. Everything is restored if Include is empty.
+	Include []string
+	Exclude []string
+
+	// StripComponents removes the given number of leading components from the restored paths,
+	// the entries with fewer components are not restored.
+	StripComponents int
+
+	// Resume allows restoring into an existing directory (e.g. to resume an interrupted restore),
+	// the files already restored (same size and mtime, and same content if CheckHash is set)
+	// are skipped, and the other existing files are handled according to Conflict.
+	Resume    bool
+	CheckHash bool
+	Conflict  string
+}
+
+// Conflict policies, for existing files that don't match the snapshot when resuming a restore.
+const (
+	ConflictOverwrite = "overwrite" // the file is replaced (the default)
+	ConflictKeep      = "keep"      // the local file is kept
+	ConflictFail      = "fail"      // the restore fails
+)
+
+// restorer walks the Meta tree, only along the branches selected by the options.
+type restorer struct {
+	bs       client.BlobStorer
+	opts     *RestoreOptions
+	include  [][]string
+	exclude  [][]string
+	dest     string
+	fullHash hash.Hash
+
+	// Limits the concurrent meta fetches
+	dirs chan struct{}
+	// Files to restore, consumed by restoreFiles workers
+	files chan *fileNode
+
+	mu   sync.Mutex
+	rr   *ReadResult
+	errs *FileErrors
+}
+
+// splitPath splits a slash separated path into its components.
+func splitPath(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// matchComponents returns true if the pattern matches the path components, or one of its
+// parent directories if prefix is true.
+func matchComponents(pattern, comps []string, prefix bool) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(comps); i++ {
+				if matchComponents(pattern[1:], comps[i:], prefix) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(comps) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], comps[0]); !ok {
+			return false
+		}
+		pattern, comps = pattern[1:], comps[1:]
+	}
+	return len(comps) == 0 || prefix
+}
+
+// matchDir returns true if the pattern may match the directory or a path inside it.
+func matchDir(pattern, comps []string) bool {
+	for len(pattern) > 0 {
+		if len(comps) == 0 || pattern[0] == "**" {
+			return true
+		}
+		if ok, _ := path.Match(pattern[0], comps[0]); !ok {
+			return false
+		}
+		pattern, comps = pattern[1:], comps[1:]
+	}
+	return true
+}
+
+func newRestorer(bs client.BlobStorer, dest string, opts *RestoreOptions) (*restorer, error) {
+	if opts == nil {
+		opts = &RestoreOptions{}
+	}
+	if opts.StripComponents < 0 {
+		return nil, fmt.Errorf("invalid strip components %d", opts.StripComponents)
+	}
+	switch opts.Conflict {
+	case "", ConflictOverwrite, ConflictKeep, ConflictFail:
+	default:
+		return nil, fmt.Errorf("invalid conflict policy %q (overwrite, keep or fail)", opts.Conflict)
+	}
+	r := &restorer{
+		bs:       bs,
+		opts:     opts,
+		dest:     dest,
+		fullHash: blake2b.New256(),
+		dirs:     make(chan struct{}, restoreDirs),
+		files:    make(chan *fileNode),
+		rr:       &ReadResult{},
+		errs:     &FileErrors{},
+	}
+	for _, pattern := range append(append([]string{}, opts.Include...), opts.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	for _, pattern := range opts.Include {
+		r.include = append(r.include, splitPath(pattern))
+	}
+	for _, pattern := range opts.Exclude {
+		r.exclude = append(r.exclude, splitPath(pattern))
+	}
+	return r, nil
+}
+
+// selected returns true if the path (relative to the snapshot root) is restored.
+func (r *restorer) selected(comps []string) bool {
+	for _, pattern := range r.exclude {
+		if matchComponents(pattern, comps, true) {
+			return false
+		}
+	}
+	if len(r.include) == 0 {
+		return true
+	}
+	for _, pattern := range r.include {
+		if matchComponents(pattern, comps, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// explore returns true if the directory contains paths that may be selected.
+func (r *restorer) explore(comps []string) bool {
+	for _, pattern := range r.exclude {
+		if matchComponents(pattern, comps, true) {
+			return false
+		}
+	}
+	if len(r.include) == 0 {
+		return true
+	}
+	for _, pattern := range r.include {
+		if matchDir(pattern, comps) {
+			return true
+		}
+	}
+	return false
+}
+
+// target returns the local path of the entry, or an empty string if all its components are stripped,
+// the names read from the metas are checked so the path can't escape the destination.
+func (r *restorer) target(comps []string) (string, error) {
+	for _, name := range comps {
+		if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') || strings.ContainsRune(name, filepath.Separator) {
+			return "", fmt.Errorf("invalid name %q in %v", name, strings.Join(comps, "/"))
+		}
+	}
+	if r.opts.StripComponents > 0 && len(comps) <= r.opts.StripComponents {
+		return "", nil
+	}
+	return filepath.Join(r.dest, filepath.Join(comps[r.opts.StripComponents:]...)), nil
+}
+
+// dirNode is a directory being restored, its metadata is applied once all its children are restored.
+type dirNode struct {
+	meta   *Meta
+	target string
+	parent *dirNode
+	// pending children (files and directories)
+	wg sync.WaitGroup
+
+	// Set if an existing directory has been made writable when resuming (to restore its mode
+	// if it's not restored from the snapshot)
+	path string
+	mode os.FileMode
+}
+
+// fileNode is a file waiting to be restored by a worker.
+type fileNode struct {
+	meta   *Meta
+	target string
+	parent *dirNode
+}
+
+func (r *restorer) addResult(rr *ReadResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rr.Add(rr)
+}
+
+func (r *restorer) addErr(path string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errs.Errors = append(r.errs.Errors, &FileError{Path: path, Err: err})
+}
+
+// fetchMetas fetches the metas of the directory children, at most restoreDirs at the same time.
+func (r *restorer) fetchMetas(meta *Meta) ([]*Meta, error) {
+	metas := make([]*Meta, len(meta.Refs))
+	errs := make([]error, len(meta.Refs))
+	var wg sync.WaitGroup
+	for i, ref := range meta.Refs {
+		hash, ok := ref.(string)
+		if !ok {
+			return nil, fmt.Errorf("dir %v (%v): unexpected ref %v", meta.Name, meta.Hash, ref)
+		}
+		wg.Add(1)
+		r.dirs <- struct{}{}
+		go func(i int, hash string) {
+			defer func() {
+				<-r.dirs
+				wg.Done()
+			}()
+			metas[i], errs[i] = NewMetaFromBlobStore(r.bs, hash)
+		}(i, hash)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch meta: %v", err)
+		}
+	}
+	return metas, nil
+}
+
+// dirExplorer recursively walks the selected branches of the tree, creates the directories,
+// and sends the files to the workers.
+func (r *restorer) dirExplorer(meta *Meta, comps []string, parent *dirNode) {
+	dir := &dirNode{meta: meta, parent: parent}
+	parent.wg.Add(1)
+	// Always notify the parent, even on error
+	defer func() {
+		go r.dirDone(dir)
+	}()
+	target, err := r.target(comps)
+	if err != nil {
+		r.addErr(path.Join(comps...), err)
+		return
+	}
+	if r.opts.Resume && target != "" {
+		if err := dir.makeWritable(target); err != nil {
+			r.addErr(target, err)
+			return
+		}
+	}
+	if r.selected(comps) && target != "" {
+		if err := os.MkdirAll(target, 0700); err != nil {
+			r.addErr(target, err)
+			return
+		}
+		dir.target = target
+		r.addResult(&ReadResult{DirsCount: 1, DirsDownloaded: 1})
+	}
+	metas, err := r.fetchMetas(meta)
+	if err != nil {
+		r.addErr(path.Join(comps...), err)
+		return
+	}
+	for _, cmeta := range metas {
+		ccomps := append(append([]string{}, comps...), cmeta.Name)
+		if cmeta.IsDir() {
+			if r.explore(ccomps) {
+				r.dirExplorer(cmeta, ccomps, dir)
+			}
+			continue
+		}
+		target, err := r.target(ccomps)
+		if err != nil {
+			r.addErr(path.Join(comps...), err)
+			continue
+		}
+		if target == "" || !r.selected(ccomps) {
+			continue
+		}
+		r.fullHash.Write([]byte(cmeta.Hash))
+		dir.wg.Add(1)
+		r.files <- &fileNode{meta: cmeta, target: target, parent: dir}
+	}
+}
+
+// makeWritable adds the owner write permission to an existing read-only directory,
+// so the files can be restored into it when resuming a restore.
+func (dir *dirNode) makeWritable(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !fi.IsDir() || fi.Mode().Perm()&0200 != 0 {
+		return nil
+	}
+	if err := os.Chmod(path, fi.Mode().Perm()|0200); err != nil {
+		return err
+	}
+	dir.path, dir.mode = path, fi.Mode().Perm()
+	return nil
+}
+
+// dirDone waits for the directory children, applies its mode/mtime (setting them before
+// would prevent writing the children, or update the mtime), and notifies its parent.
+func (r *restorer) dirDone(dir *dirNode) {
+	dir.wg.Wait()
+	switch {
+	case dir.target != "":
+		if err := setMeta(dir.target, dir.meta); err != nil {
+			r.addErr(dir.target, err)
+		}
+	case dir.path != "":
+		// Not restored from the snapshot, but made writable to restore its content
+		if err := os.Chmod(dir.path, dir.mode); err != nil {
+			r.addErr(dir.path, err)
+		}
+	}
+	dir.parent.wg.Done()
+}
+
+// fileWorker restores the files sent by the explorer.
+func (r *restorer) fileWorker() {
+	for f := range r.files {
+		rr := &ReadResult{}
+		if err := r.restoreFile(f.meta, f.target, rr); err != nil {
+			r.addErr(f.target, err)
+		} else {
+			r.addResult(rr)
+		}
+		f.parent.wg.Done()
+	}
+}
+
+// restoreFile downloads the file to a temporary file, renamed once its mode/mtime are set,
+// so an interrupted restore never leaves a partial file that would be considered as restored.
+func (r *restorer) restoreFile(meta *Meta, target string, rr *ReadResult) error {
+	if r.opts.Resume {
+		fi, err := os.Lstat(target)
+		switch {
+		case err == nil:
+			restored, err := r.restored(target, fi, meta)
+			if err != nil {
+				return err
+			}
+			if restored {
+				rr.FilesCount++
+				rr.FilesSkipped++
+				rr.Size += meta.Size
+				return nil
+			}
+			switch r.opts.Conflict {
+			case ConflictKeep:
+				rr.FilesCount++
+				rr.FilesKept++
+				return nil
+			case ConflictFail:
+				return fmt.Errorf("%v already exists and doesn't match the snapshot", target)
+			}
+			if fi.IsDir() {
+				return fmt.Errorf("failed to restore %v: is a directory", target)
+			}
+		case !os.IsNotExist(err):
+			return err
+		}
+	}
+	dir, name := filepath.Split(target)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, "."+name+".blobsnap-restore")
+	crr, err := r.download(meta, tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := setMeta(tmp, meta); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	rr.Add(crr)
+	return nil
+}
+
+type blobResult struct {
+	data []byte
+	err  error
+}
+
+// download writes the content of the file to path, the blobs are fetched in
+// the background, up to prefetchBlobs blobs ahead of the one being written.
+func (r *restorer) download(meta *Meta, path string) (*ReadResult, error) {
+	// Parse (and check) the refs
+	ffile, err := NewFakeFile(r.bs, meta)
+	if err != nil {
+		return nil, err
+	}
+	defer ffile.Close()
+	results := make([]chan *blobResult, len(ffile.lmrange))
+	for i := range results {
+		results[i] = make(chan *blobResult, 1)
+	}
+	prefetch := make(chan struct{}, prefetchBlobs)
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		for i, iv := range ffile.lmrange {
+			select {
+			case prefetch <- struct{}{}:
+			case <-quit:
+				return
+			}
+			if iv.Value == "" {
+				// Nothing to fetch for holes
+				results[i] <- &blobResult{}
+				continue
+			}
+			go func(i int, hash string) {
+				data, err := r.bs.Get(hash)
+				results[i] <- &blobResult{data, err}
+			}(i, iv.Value)
+		}
+	}()
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := blake2b.New256()
+	w := io.MultiWriter(f, h)
+	rr := &ReadResult{}
+	for i, result := range results {
+		blob := <-result
+		<-prefetch
+		if iv := ffile.lmrange[i]; iv.Value == "" {
+			// Skip the hole, so the file is sparse
+			holeSize := iv.Index - rr.Size
+			if _, err := f.Seek(int64(holeSize), os.SEEK_CUR); err != nil {
+				return nil, err
+			}
+			for n := holeSize; n > 0; n -= holeBlockSize {
+				if n < holeBlockSize {
+					h.Write(zeroBlock[:n])
+				} else {
+					h.Write(zeroBlock)
+				}
+			}
+			rr.Size += holeSize
+			continue
+		}
+		if blob.err != nil {
+			return nil, fmt.Errorf("failed to fetch blob %v: %v", ffile.lmrange[i].Value, blob.err)
+		}
+		if _, err := w.Write(blob.data); err != nil {
+			return nil, err
+		}
+		rr.BlobsCount++
+		rr.BlobsDownloaded++
+		rr.Size += len(blob.data)
+		rr.SizeDownloaded += len(blob.data)
+	}
+	// Set the size if the file ends with a hole
+	if err := f.Truncate(int64(rr.Size)); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if rr.Size != meta.Size {
+		return nil, fmt.Errorf("file %+v not successfully restored, size:%v/expected size:%v",
+			meta, rr.Size, meta.Size)
+	}
+	rr.Hash = fmt.Sprintf("%x", h.Sum(nil))
+	rr.FilesCount++
+	rr.FilesDownloaded++
+	return rr, nil
+}
+
+// restored returns true if the existing file matches the Meta.
+func (r *restorer) restored(path string, fi os.FileInfo, meta *Meta) (bool, error) {
+	if !fi.Mode().IsRegular() || int(fi.Size()) != meta.Size {
+		return false, nil
+	}
+	mtime, err := time.Parse(time.RFC3339, meta.ModTime)
+	if err != nil || !fi.ModTime().Truncate(time.Second).Equal(mtime) {
+		return false, nil
+	}
+	if !r.opts.CheckHash || meta.Size == 0 {
+		return true, nil
+	}
+	ffile, err := NewFakeFile(nil, meta)
+	if err != nil {
+		return false, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	// Split the local file like the uploader, and compare the blobs with the refs
+	errMismatch := errors.New("mismatch")
+	i := 0
+	_, err = splitReader(context.Background(), f, ffile.sparse(), func(hash string, _ []byte, index int) error {
+		if i >= len(ffile.lmrange) || ffile.lmrange[i].Value != hash || ffile.lmrange[i].Index != index {
+			return errMismatch
+		}
+		i++
+		return nil
+	})
+	switch {
+	case err == errMismatch:
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("failed to read %v: %v", path, err)
+	}
+	return i == len(ffile.lmrange), nil
+}
+
+// setMeta applies the mode and the mtime stored in the Meta to the file.
+func setMeta(path string, meta *Meta) error {
+	if meta.Mode != 0 {
+		if err := os.Chmod(path, os.FileMode(meta.Mode).Perm()); err != nil {
+			return err
+		}
+	}
+	if meta.ModTime != "" {
+		mtime, err := time.Parse(time.RFC3339, meta.ModTime)
+		if err != nil {
+			return fmt.Errorf("bad mtime %q for %v: %v", meta.ModTime, path, err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreWithOptions restores the files/directories of the snapshot referenced by key
+// selected by the options to path, only the matching branches of the tree are fetched.
+func RestoreWithOptions(bs client.BlobStorer, key, path string, opts *RestoreOptions) (*ReadResult, error) {
+	r, err := newRestorer(bs, path, opts)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := NewMetaFromBlobStore(bs, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch meta: %v", err)
+	}
+	if !meta.IsDir() {
+		rr := &ReadResult{}
+		if err := r.restoreFile(meta, path, rr); err != nil {
+			return nil, err
+		}
+		rr.Hash = meta.Hash
+		return rr, nil
+	}
+	if r.opts.Resume {
+		err = os.MkdirAll(path, 0700)
+	} else {
+		// Like GetDir, the directory must not exist
+		err = os.Mkdir(path, 0700)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < restoreFiles; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.fileWorker()
+		}()
+	}
+	// The root directory notifies this (virtual) parent once the whole tree is restored
+	top := &dirNode{}
+	r.dirExplorer(meta, nil, top)
+	close(r.files)
+	wg.Wait()
+	top.wg.Wait()
+	if len(r.errs.Errors) > 0 {
+		return r.rr, r.errs
+	}
+	r.rr.Hash = fmt.Sprintf("%x", r.fullHash.Sum(nil))
+	return r.rr, nil
+}
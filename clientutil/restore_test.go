@@ -0,0 +1,385 @@
+package clientutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dchest/blake2b"
+	"golang.org/x/net/context"
+)
+
+// memStore is an in-memory BlobStorer, the Get of the blobs marked as failing returns an error.
+type memStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+	fail  map[string]bool
+}
+
+func newMemStore() *memStore {
+	return &memStore{blobs: map[string][]byte{}, fail: map[string]bool{}}
+}
+
+func (s *memStore) Get(hash string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail[hash] {
+		return nil, errors.New("blob unavailable")
+	}
+	blob, ok := s.blobs[hash]
+	if !ok {
+		return nil, fmt.Errorf("blob %v not found", hash)
+	}
+	return blob, nil
+}
+
+func (s *memStore) Stat(hash string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.blobs[hash]
+	return ok, nil
+}
+
+func (s *memStore) Put(hash string, blob []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[hash] = blob
+	return nil
+}
+
+var testMtime = time.Date(2015, 5, 12, 17, 25, 47, 0, time.UTC)
+
+// putMeta stores the Meta and sets its hash.
+func (s *memStore) putMeta(t *testing.T, meta *Meta) *Meta {
+	hash, js, err := meta.Json()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(hash, js)
+	meta.Hash = hash
+	return meta
+}
+
+// putFile stores a file made of the given blobs.
+func (s *memStore) putFile(t *testing.T, name string, mode uint32, blobs ...string) *Meta {
+	meta := &Meta{Name: name, Type: "file", Mode: mode, ModTime: testMtime.Format(time.RFC3339), Version: "1"}
+	for _, blob := range blobs {
+		hash := fmt.Sprintf("%x", blake2b.Sum256([]byte(blob)))
+		s.Put(hash, []byte(blob))
+		meta.Size += len(blob)
+		meta.AddIndexedRef(meta.Size, hash)
+	}
+	return s.putMeta(t, meta)
+}
+
+// putDir stores a directory containing the given metas.
+func (s *memStore) putDir(t *testing.T, name string, mode uint32, children ...*Meta) *Meta {
+	meta := &Meta{Name: name, Type: "dir", Mode: mode, ModTime: testMtime.Format(time.RFC3339), Version: "1"}
+	for _, child := range children {
+		meta.AddRef(child.Hash)
+	}
+	return s.putMeta(t, meta)
+}
+
+func TestRestorerSelect(t *testing.T) {
+	r, err := newRestorer(nil, "/dest", &RestoreOptions{
+		Include: []string{"etc/hosts", "home/*/.bashrc", "var/lib", "**/*.conf"},
+		Exclude: []string{"var/lib/cache"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tdata := range []struct {
+		path     string
+		selected bool
+		explore  bool
+	}{
+		{"etc", false, true},
+		{"etc/hosts", true, true},
+		{"etc/passwd", false, true},
+		{"etc/nginx/nginx.conf", true, true},
+		{"home/thomas/.bashrc", true, true},
+		{"home/thomas/.profile", false, true},
+		{"var/lib", true, true},
+		{"var/lib/app/data", true, true},
+		{"var/lib/cache", false, false},
+		{"var/lib/cache/file", false, false},
+		{"usr", false, true},
+	} {
+		comps := splitPath(tdata.path)
+		if r.selected(comps) != tdata.selected {
+			t.Errorf("%v: selected=%v, expected %v", tdata.path, !tdata.selected, tdata.selected)
+		}
+		if r.explore(comps) != tdata.explore {
+			t.Errorf("%v: explore=%v, expected %v", tdata.path, !tdata.explore, tdata.explore)
+		}
+	}
+	if _, err := newRestorer(nil, "/dest", &RestoreOptions{Include: []string{"[a"}}); err == nil {
+		t.Errorf("invalid pattern should be rejected")
+	}
+}
+
+func TestRestorerTarget(t *testing.T) {
+	r, err := newRestorer(nil, "/dest", &RestoreOptions{StripComponents: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{
+		"":          "",
+		"a":         "",
+		"a/b":       "",
+		"a/b/c":     filepath.Join("/dest", "c"),
+		"a/b/c/d.x": filepath.Join("/dest", "c", "d.x"),
+	} {
+		target, err := r.target(splitPath(path))
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", path, err)
+			continue
+		}
+		if target != expected {
+			t.Errorf("%q: target=%q, expected %q", path, target, expected)
+		}
+	}
+	// Names read from the metas must not escape the destination
+	for _, comps := range [][]string{
+		{"a", "b", ".."},
+		{"a", "b", "..", "..", "..", "etc"},
+		{"a", "b", "c/../../../x"},
+		{"a", "b", "."},
+		{"a", "", "c"},
+	} {
+		if target, err := r.target(comps); err == nil {
+			t.Errorf("%q should be rejected, got %q", comps, target)
+		}
+	}
+}
+
+func TestRestorerRestored(t *testing.T) {
+	f, err := ioutil.TempFile("", "blobsnap-restored-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := f.Name()
+	defer os.Remove(path)
+	content := bytes.Repeat([]byte("blobsnap"), 1<<15)
+	if _, err := f.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	mtime := time.Date(2015, 5, 12, 17, 25, 47, 0, time.UTC)
+	meta := &Meta{Name: "file", Type: "file", Size: len(content), ModTime: mtime.Format(time.RFC3339), Mode: 0600}
+	if _, err := splitReader(context.Background(), bytes.NewReader(content), false, func(hash string, _ []byte, index int) error {
+		meta.AddIndexedRef(index, hash)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setMeta(path, meta); err != nil {
+		t.Fatal(err)
+	}
+	check := func(checkHash, expected bool) {
+		r, err := newRestorer(nil, "/dest", &RestoreOptions{Resume: true, CheckHash: checkHash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := r.restored(path, fi, meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored != expected {
+			t.Errorf("restored=%v (check hash %v), expected %v", restored, checkHash, expected)
+		}
+	}
+	check(false, true)
+	check(true, true)
+
+	// Same size and mtime, but a different content
+	content[len(content)/2] = 'x'
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := setMeta(path, meta); err != nil {
+		t.Fatal(err)
+	}
+	check(false, true)
+	check(true, false)
+
+	if err := os.Chtimes(path, time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	check(false, false)
+}
+
+func TestDirNodeMakeWritable(t *testing.T) {
+	path, err := ioutil.TempDir("", "blobsnap-writable-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+	if err := os.Chmod(path, 0555); err != nil {
+		t.Fatal(err)
+	}
+	dir := &dirNode{}
+	if err := dir.makeWritable(path); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0755 || dir.path != path || dir.mode != 0555 {
+		t.Errorf("mode %o (saved %q %o), expected 755 (saved %q 555)", fi.Mode().Perm(), dir.path, dir.mode, path)
+	}
+
+	// Writable and missing directories are left untouched
+	for _, p := range []string{path, filepath.Join(path, "missing")} {
+		dir := &dirNode{}
+		if err := dir.makeWritable(p); err != nil || dir.path != "" {
+			t.Errorf("%v: saved %q, err %v", p, dir.path, err)
+		}
+	}
+}
+
+func TestRestoreWithOptions(t *testing.T) {
+	s := newMemStore()
+	root := s.putDir(t, "root", 0755,
+		s.putFile(t, "a.txt", 0644, "hello ", "world"),
+		s.putFile(t, "empty", 0600),
+		s.putDir(t, "ro", 0555,
+			s.putFile(t, "b.txt", 0444, "read-only"),
+			s.putDir(t, "sub", 0700, s.putFile(t, "c.txt", 0640, "c")),
+		),
+	)
+	tmp, err := ioutil.TempDir("", "blobsnap-restore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		filepath.Walk(tmp, func(p string, fi os.FileInfo, err error) error {
+			if err == nil && fi.IsDir() {
+				os.Chmod(p, 0700)
+			}
+			return nil
+		})
+		os.RemoveAll(tmp)
+	}()
+	dest := filepath.Join(tmp, "dest")
+	rr, err := RestoreWithOptions(s, root.Hash, dest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.FilesCount != 4 || rr.DirsCount != 3 || rr.Size != len("hello world")+len("read-only")+len("c") {
+		t.Errorf("unexpected result %+v", rr)
+	}
+	for p, expected := range map[string]struct {
+		mode    os.FileMode
+		content string
+	}{
+		"":             {os.ModeDir | 0755, ""},
+		"a.txt":        {0644, "hello world"},
+		"empty":        {0600, ""},
+		"ro":           {os.ModeDir | 0555, ""},
+		"ro/b.txt":     {0444, "read-only"},
+		"ro/sub":       {os.ModeDir | 0700, ""},
+		"ro/sub/c.txt": {0640, "c"},
+	} {
+		path := filepath.Join(dest, filepath.FromSlash(p))
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		// The directories mtime must be set once their content is restored
+		if fi.Mode() != expected.mode || !fi.ModTime().Equal(testMtime) {
+			t.Errorf("%q: mode %v mtime %v, expected %v %v", p, fi.Mode(), fi.ModTime(), expected.mode, testMtime)
+		}
+		if fi.IsDir() {
+			continue
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(content) != expected.content {
+			t.Errorf("%q: content %q, expected %q", p, content, expected.content)
+		}
+	}
+
+	// The other files are still restored if one of them fails, and the errors are aggregated
+	failing := s.putFile(t, "failing", 0644, "will", "not", "be", "restored")
+	s.fail[failing.Refs[1].([]interface{})[1].(string)] = true
+	root = s.putDir(t, "root", 0755,
+		s.putFile(t, "a.txt", 0644, "hello ", "world"),
+		failing,
+		s.putDir(t, "dir", 0755, failing, s.putFile(t, "d.txt", 0644, "d")),
+	)
+	dest = filepath.Join(tmp, "dest2")
+	_, err = RestoreWithOptions(s, root.Hash, dest, nil)
+	errs, ok := err.(*FileErrors)
+	if !ok {
+		t.Fatalf("expected a *FileErrors, got %v", err)
+	}
+	if len(errs.Errors) != 2 {
+		t.Errorf("expected 2 errors, got %v", errs.Errors)
+	}
+	for _, ferr := range errs.Errors {
+		if filepath.Base(ferr.Path) != "failing" || !strings.Contains(ferr.Err.Error(), "blob unavailable") {
+			t.Errorf("unexpected error %v", ferr)
+		}
+	}
+	for _, p := range []string{"a.txt", "dir/d.txt"} {
+		if _, err := os.Stat(filepath.Join(dest, filepath.FromSlash(p))); err != nil {
+			t.Error(err)
+		}
+	}
+	// Neither the failed files nor their temporary files are left
+	for _, p := range []string{"failing", ".failing.blobsnap-restore", "dir/failing", "dir/.failing.blobsnap-restore"} {
+		if _, err := os.Lstat(filepath.Join(dest, filepath.FromSlash(p))); !os.IsNotExist(err) {
+			t.Errorf("%v should not exist (%v)", p, err)
+		}
+	}
+}
+
+func TestRestorerDownloadFailure(t *testing.T) {
+	s := newMemStore()
+	blobs := []string{}
+	for i := 0; i < 4*prefetchBlobs; i++ {
+		blobs = append(blobs, fmt.Sprintf("blob %d", i))
+	}
+	meta := s.putFile(t, "file", 0644, blobs...)
+	s.fail[meta.Refs[1].([]interface{})[1].(string)] = true
+	r, err := newRestorer(s, "/dest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "blobsnap-download-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	goroutines := runtime.NumGoroutine()
+	if _, err := r.download(meta, filepath.Join(tmp, "file")); err == nil || !strings.Contains(err.Error(), "blob unavailable") {
+		t.Fatalf("expected the blob error, got %v", err)
+	}
+	// Returning early must stop the prefetching
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left, expected %d", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,271 @@
+package clientutil
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// tarNode is a file/directory of a tar archive.
+type tarNode struct {
+	name string
+	// nil for the directories only implied by the paths of the archive
+	hdr      *tar.Header
+	children map[string]*tarNode
+
+	// Upload result of the files
+	meta *Meta
+	wr   *WriteResult
+}
+
+func newTarNode(name string) *tarNode {
+	return &tarNode{name: name, children: map[string]*tarNode{}}
+}
+
+func (n *tarNode) isDir() bool {
+	return n.hdr == nil || n.hdr.Typeflag == tar.TypeDir
+}
+
+// child returns the node located at the slash separated path, creating it (and its parents) if needed.
+func (n *tarNode) child(p string) *tarNode {
+	for _, name := range strings.Split(p, "/") {
+		cnode, ok := n.children[name]
+		if !ok || !cnode.isDir() {
+			cnode = newTarNode(name)
+			n.children[name] = cnode
+		}
+		n = cnode
+	}
+	return n
+}
+
+// lookup returns the node located at the slash separated path, or nil if it doesn't exist.
+func (n *tarNode) lookup(p string) *tarNode {
+	for _, name := range strings.Split(p, "/") {
+		if n = n.children[name]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// cleanTarPath returns the slash separated path relative to the archive root ("" for the root).
+func cleanTarPath(name string) (string, error) {
+	p := strings.TrimPrefix(path.Clean("/"+name), "/")
+	for _, comp := range strings.Split(name, "/") {
+		if comp == ".." {
+			return "", fmt.Errorf("invalid path %v", name)
+		}
+	}
+	return p, nil
+}
+
+// PutTar uploads the content of the tar archive (optionally gzip'ed) read from r, with the same
+// Meta tree as PutDir would upload for the extracted archive (so the blobs and metas are deduplicated),
+// without extracting it. If the archive contains a single top-level directory it's the root,
+// otherwise the top-level entries are grouped in a directory called name (with the mode/mtime
+// of the "./" entry if any).
+func (up *Uploader) PutTar(name string, r io.Reader) (*Meta, *WriteResult, error) {
+	return up.PutTarContext(context.Background(), name, r)
+}
+
+// PutTarContext is like PutTar, but the upload is stopped if the context is canceled.
+func (up *Uploader) PutTarContext(ctx context.Context, name string, r io.Reader) (*Meta, *WriteResult, error) {
+	br := bufio.NewReader(r)
+	// Detect the gzip header
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read the archive: %v", err)
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+	root := newTarNode(name)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read the archive: %v", err)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		p, err := cleanTarPath(hdr.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if p == "" {
+			// The "./" entry of the archives created from inside the directory
+			if hdr.Typeflag == tar.TypeDir {
+				root.hdr = hdr
+			}
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			root.child(p).hdr = hdr
+		case tar.TypeReg, tar.TypeRegA:
+			node := root.child(p)
+			node.hdr = hdr
+			node.meta, node.wr, err = up.putTarFile(ctx, node.name, hdr, tr)
+			if err != nil {
+				return nil, nil, err
+			}
+		case tar.TypeLink:
+			// Hard links are stored like PutDir stores each link of a file, with the content of the target
+			target, err := cleanTarPath(hdr.Linkname)
+			if err != nil {
+				return nil, nil, err
+			}
+			tnode := root.lookup(target)
+			if tnode == nil || tnode.meta == nil {
+				log.Printf("Uploader: skipping %v (hard link to missing file %v)", hdr.Name, hdr.Linkname)
+				continue
+			}
+			node := root.child(p)
+			node.hdr = hdr
+			node.meta, node.wr, err = up.putTarLink(node.name, tnode)
+			if err != nil {
+				return nil, nil, err
+			}
+		default:
+			// Like PutDir, only files and directories are stored
+			log.Printf("Uploader: skipping %v (unsupported tar entry type %q)", hdr.Name, hdr.Typeflag)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if root.hdr == nil && len(root.children) == 1 {
+		for _, cnode := range root.children {
+			if cnode.isDir() {
+				root = cnode
+			}
+		}
+	}
+	return up.putTarDir(root)
+}
+
+// putTarFile uploads a file of the archive like putFile.
+func (up *Uploader) putTarFile(ctx context.Context, name string, hdr *tar.Header, r io.Reader) (*Meta, *WriteResult, error) {
+	up.StartUpload()
+	defer up.UploadDone()
+	fi := hdr.FileInfo()
+	meta := NewMeta()
+	meta.Name = name
+	meta.Size = int(fi.Size())
+	meta.Type = "file"
+	meta.ModTime = fi.ModTime().Format(time.RFC3339)
+	meta.Mode = uint32(fi.Mode())
+	wr := NewWriteResult()
+	if fi.Size() > 0 {
+		cwr, err := up.writeReader(ctx, r, meta)
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return nil, nil, err
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("FileWriter error: %v", err)
+		}
+		wr.free()
+		wr = cwr
+		meta.Size = wr.Size
+	}
+	if err := up.putMeta(meta, wr); err != nil {
+		return nil, nil, err
+	}
+	return meta, wr, nil
+}
+
+// putTarLink uploads the Meta of a hard link to an already uploaded file of the archive,
+// its blobs are reused (and reported as skipped, like PutDir does for the other links).
+func (up *Uploader) putTarLink(name string, target *tarNode) (*Meta, *WriteResult, error) {
+	meta := NewMeta()
+	meta.Name = name
+	meta.Size = target.meta.Size
+	meta.Type = "file"
+	meta.ModTime = target.meta.ModTime
+	meta.Mode = target.meta.Mode
+	wr := NewWriteResult()
+	wr.Hash = target.wr.Hash
+	prev := 0
+	for _, ref := range target.meta.Refs {
+		iref := ref.([]interface{})
+		index, hash := iref[0].(int), iref[1].(string)
+		meta.AddIndexedRef(index, hash)
+		size := index - prev
+		prev = index
+		wr.Size += size
+		if hash == "" {
+			wr.SizeSparse += size
+			continue
+		}
+		wr.SizeSkipped += size
+		wr.BlobsSkipped++
+		wr.BlobsCount++
+	}
+	if err := up.putMeta(meta, wr); err != nil {
+		return nil, nil, err
+	}
+	return meta, wr, nil
+}
+
+// putTarDir uploads the directory once its children are uploaded, like DirWriterNode.
+func (up *Uploader) putTarDir(node *tarNode) (*Meta, *WriteResult, error) {
+	wr := NewWriteResult()
+	hashes := []string{}
+	// Directories not stored in the archive get the most recent mtime of their children
+	var mtime time.Time
+	names := []string{}
+	for name := range node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cnode := node.children[name]
+		cmeta, cwr := cnode.meta, cnode.wr
+		if cnode.isDir() {
+			var err error
+			cmeta, cwr, err = up.putTarDir(cnode)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if t, err := time.Parse(time.RFC3339, cmeta.ModTime); err == nil && t.After(mtime) {
+			mtime = t
+		}
+		hashes = append(hashes, cmeta.Hash)
+		wr.Add(cwr)
+		cwr.free()
+		cmeta.free()
+	}
+	up.StartDirUpload()
+	defer up.DirUploadDone()
+	wr.DirsUploaded++
+	wr.DirsCount++
+	mode := os.ModeDir | 0755
+	if node.hdr != nil {
+		fi := node.hdr.FileInfo()
+		mode, mtime = fi.Mode(), fi.ModTime()
+	}
+	meta, err := up.putDirMeta(node.name, mode, mtime, hashes, wr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return meta, wr, nil
+}
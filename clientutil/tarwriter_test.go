@@ -0,0 +1,129 @@
+package clientutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanTarPath(t *testing.T) {
+	for name, expected := range map[string]string{
+		"dir/file":    "dir/file",
+		"./dir/file":  "dir/file",
+		"/dir/file":   "dir/file",
+		"dir/":        "dir",
+		"./":          "",
+		"dir//./file": "dir/file",
+	} {
+		if p, err := cleanTarPath(name); err != nil || p != expected {
+			t.Errorf("%q: got %q (err=%v), expected %q", name, p, err, expected)
+		}
+	}
+	for _, name := range []string{"../etc/passwd", "dir/../../file"} {
+		if _, err := cleanTarPath(name); err == nil {
+			t.Errorf("%q should be rejected", name)
+		}
+	}
+}
+
+func TestTarNodeChild(t *testing.T) {
+	root := newTarNode("archive")
+	file := root.child("dir/sub/file")
+	file.hdr = &tar.Header{Typeflag: tar.TypeReg}
+	// The parent directories are implied by the path
+	dir := root.child("dir")
+	dir.hdr = &tar.Header{Typeflag: tar.TypeDir}
+	if dir.children["sub"].children["file"] != file {
+		t.Errorf("the directory should keep its children")
+	}
+	if root.child("dir") != dir {
+		t.Errorf("the existing directory should be returned")
+	}
+	// Like when extracting the archive, a later entry replaces the file
+	if root.child("dir/sub/file") == file || dir.children["sub"].children["file"] == file {
+		t.Errorf("the file should be replaced")
+	}
+}
+
+func TestPutTarHardLink(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "blobsnap-tar-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "archive")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("blobsnap"), 1<<16)
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(file, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{file, dir} {
+		if err := os.Chmod(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, testMtime, testMtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The same tree, as written by tar
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "archive/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: testMtime},
+		{Name: "archive/file", Typeflag: tar.TypeReg, Mode: 0755, ModTime: testMtime, Size: int64(len(content))},
+		{Name: "archive/link", Typeflag: tar.TypeLink, Mode: 0755, ModTime: testMtime, Linkname: "archive/file"},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write(content)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newMemStore()
+	up := NewUploader(s, nil)
+	meta, wr, err := up.PutTar("archive", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wr.FilesCount != 1 || wr.BlobsSkipped == 0 || wr.SizeSkipped < len(content) {
+		t.Errorf("the link content should be skipped, got %+v", wr)
+	}
+	dmeta, _, err := up.PutDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Hash != dmeta.Hash {
+		t.Errorf("tar tree %v, expected the PutDir tree %v", meta.Hash, dmeta.Hash)
+	}
+	metas := map[string]*Meta{}
+	for _, ref := range meta.Refs {
+		cmeta, err := NewMetaFromBlobStore(s, ref.(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		metas[cmeta.Name] = cmeta
+	}
+	fmeta, lmeta := metas["file"], metas["link"]
+	if fmeta == nil || lmeta == nil {
+		t.Fatalf("missing file or link in %v", metas)
+	}
+	if lmeta.Size != len(content) || fmt.Sprint(lmeta.Refs) != fmt.Sprint(fmeta.Refs) {
+		t.Errorf("the link should have the content of the file, got %+v", lmeta)
+	}
+}
@@ -1,13 +1,12 @@
 package clientutil
 
-import (
-	gignore "github.com/sabhiram/go-git-ignore"
-	"github.com/tsileo/blobstash/client/interface"
-)
+import "github.com/tsileo/blobstash/client/interface"
 
 var (
 	uploader    = 25 // concurrent upload uploaders
 	dirUploader = 12 // concurrent directory uploaders
+
+	changedRetries = 3 // default retries for files modified during the upload
 )
 
 type Uploader struct {
@@ -17,19 +16,41 @@ type Uploader struct {
 	uploader    chan struct{}
 	dirUploader chan struct{}
 
-	Ignorer *gignore.GitIgnore
-	Root    string
+	// Excludes defines the files/directories left out of PutDir (in addition to the ignore files)
+	Excludes *Excludes
+
+	// Strict makes PutDir fail on unreadable/vanished files and directories,
+	// instead of skipping them
+	Strict bool
+
+	// ChangedRetries is the number of times the upload of a file modified while being read is retried
+	ChangedRetries int
+
+	// Sparse stores the regions of zeros of the files as holes instead of blobs
+	Sparse bool
+
+	// RecordExcluded keeps the excluded paths in the WriteResult (with the size of the excluded
+	// directories content), otherwise they're only counted
+	RecordExcluded bool
 }
 
 func NewUploader(bs client.BlobStorer, kvs client.KvStorer) *Uploader {
 	return &Uploader{
-		bs:          bs,
-		kvs:         kvs,
-		uploader:    make(chan struct{}, uploader),
-		dirUploader: make(chan struct{}, dirUploader),
+		bs:             bs,
+		kvs:            kvs,
+		uploader:       make(chan struct{}, uploader),
+		dirUploader:    make(chan struct{}, dirUploader),
+		ChangedRetries: changedRetries,
 	}
 }
 
+// Copy returns a copy of the Uploader sharing the same upload limits,
+// so the options can be changed for a single upload.
+func (up *Uploader) Copy() *Uploader {
+	nup := *up
+	return &nup
+}
+
 // Block until the client can start the upload, thus limiting the number of file descriptor used.
 func (up *Uploader) StartUpload() {
 	up.uploader <- struct{}{}
@@ -3,10 +3,12 @@ package clientutil
 import (
 	"bufio"
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"sync"
+	"unicode"
 
 	"github.com/dchest/blake2b"
 	"github.com/dustin/go-humanize"
@@ -40,36 +42,98 @@ func NewID() string {
 
 // a WriteResult keeps track of the number of blobs uploaded/skipped, and basic stats.
 type WriteResult struct {
-	Hash string
+	Hash string `json:"hash"`
 
-	Size         int
-	SizeSkipped  int
-	SizeUploaded int
+	Size         int `json:"size"`
+	SizeSkipped  int `json:"size_skipped"`
+	SizeUploaded int `json:"size_uploaded"`
+	// Size of the holes of the sparse files (not uploaded, included in Size)
+	SizeSparse int `json:"size_sparse"`
 
-	BlobsCount    int
-	BlobsSkipped  int
-	BlobsUploaded int
+	BlobsCount    int `json:"blobs_count"`
+	BlobsSkipped  int `json:"blobs_skipped"`
+	BlobsUploaded int `json:"blobs_uploaded"`
 
-	FilesCount    int
-	FilesSkipped  int
-	FilesUploaded int
+	FilesCount    int `json:"files_count"`
+	FilesSkipped  int `json:"files_skipped"`
+	FilesUploaded int `json:"files_uploaded"`
 
-	DirsCount    int
-	DirsSkipped  int
-	DirsUploaded int
+	DirsCount    int `json:"dirs_count"`
+	DirsSkipped  int `json:"dirs_skipped"`
+	DirsUploaded int `json:"dirs_uploaded"`
 
-	AlreadyExists bool
+	// Unreadable/vanished files and directories that have been skipped
+	FilesUnreadable int `json:"files_unreadable"`
+	DirsUnreadable  int `json:"dirs_unreadable"`
+
+	// Files modified during the upload
+	FilesInconsistent int `json:"files_inconsistent"`
+
+	// Files/directories excluded by the ignore files/exclude rules (SizeExcluded only includes
+	// the directories content if the Uploader records the excluded paths)
+	FilesExcluded int `json:"files_excluded"`
+	DirsExcluded  int `json:"dirs_excluded"`
+	SizeExcluded  int `json:"size_excluded"`
+
+	AlreadyExists bool `json:"already_exists"`
+
+	// Errors of the skipped files/directories
+	Errors []string `json:"-"`
+
+	// Paths of the inconsistent files
+	Inconsistent []string `json:"-"`
+
+	// Excluded files/directories (only if the Uploader records them)
+	Excluded []*ExcludedPath `json:"-"`
 }
 
 func NewWriteResult() *WriteResult {
 	return wrPool.Get().(*WriteResult)
 }
 
+// UnmarshalJSON decodes a WriteResult, the snapshots saved by older versions
+// stored it with the Go field names (e.g. SizeUploaded for size_uploaded).
+func (wr *WriteResult) UnmarshalJSON(data []byte) error {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if _, legacy := fields["Size"]; legacy {
+		snakeFields := map[string]json.RawMessage{}
+		for name, value := range fields {
+			snakeFields[snakeCase(name)] = value
+		}
+		var err error
+		if data, err = json.Marshal(snakeFields); err != nil {
+			return err
+		}
+	}
+	// Without the UnmarshalJSON method
+	type writeResult WriteResult
+	return json.Unmarshal(data, (*writeResult)(wr))
+}
+
+// snakeCase converts a Go field name to its JSON name (FilesCount to files_count).
+func snakeCase(name string) string {
+	res := []rune{}
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				res = append(res, '_')
+			}
+			r = unicode.ToLower(r)
+		}
+		res = append(res, r)
+	}
+	return string(res)
+}
+
 func (wr *WriteResult) Reset() {
 	wr.Hash = ""
 	wr.Size = 0
 	wr.SizeSkipped = 0
 	wr.SizeUploaded = 0
+	wr.SizeSparse = 0
 	wr.BlobsCount = 0
 	wr.BlobsSkipped = 0
 	wr.BlobsUploaded = 0
@@ -79,7 +143,16 @@ func (wr *WriteResult) Reset() {
 	wr.DirsCount = 0
 	wr.DirsSkipped = 0
 	wr.DirsUploaded = 0
+	wr.FilesUnreadable = 0
+	wr.DirsUnreadable = 0
+	wr.FilesInconsistent = 0
+	wr.FilesExcluded = 0
+	wr.DirsExcluded = 0
+	wr.SizeExcluded = 0
 	wr.AlreadyExists = false
+	wr.Errors = nil
+	wr.Inconsistent = nil
+	wr.Excluded = nil
 }
 
 func (wr *WriteResult) free() {
@@ -87,6 +160,7 @@ func (wr *WriteResult) free() {
 	wr.Size = 0
 	wr.SizeSkipped = 0
 	wr.SizeUploaded = 0
+	wr.SizeSparse = 0
 	wr.BlobsCount = 0
 	wr.BlobsSkipped = 0
 	wr.BlobsUploaded = 0
@@ -96,21 +170,36 @@ func (wr *WriteResult) free() {
 	wr.DirsCount = 0
 	wr.DirsSkipped = 0
 	wr.DirsUploaded = 0
+	wr.FilesUnreadable = 0
+	wr.DirsUnreadable = 0
+	wr.FilesInconsistent = 0
+	wr.FilesExcluded = 0
+	wr.DirsExcluded = 0
+	wr.SizeExcluded = 0
 	wr.AlreadyExists = false
+	wr.Errors = nil
+	wr.Inconsistent = nil
+	wr.Excluded = nil
 	wrPool.Put(wr)
 }
 
 func (wr *WriteResult) String() string {
 	return fmt.Sprintf(`Write Result:
-- Size: %v (skipped:%v, uploaded:%v)
+- Size: %v (skipped:%v, uploaded:%v, sparse:%v)
 - Blobs: %d (skipped:%d, uploaded:%d)
 - Files: %d (skipped:%d, uploaded:%d)
 - Dirs: %d (skipped:%d, uploaded:%d)
+- Unreadable: %d files, %d dirs
+- Inconsistent: %d files
+- Excluded: %d files, %d dirs (%v)
 `,
-		humanize.Bytes(uint64(wr.Size)), wr.SizeSkipped, wr.SizeUploaded,
+		humanize.Bytes(uint64(wr.Size)), wr.SizeSkipped, wr.SizeUploaded, wr.SizeSparse,
 		wr.BlobsCount, wr.BlobsSkipped, wr.BlobsUploaded,
 		wr.FilesCount, wr.FilesSkipped, wr.FilesUploaded,
-		wr.DirsCount, wr.DirsSkipped, wr.DirsUploaded)
+		wr.DirsCount, wr.DirsSkipped, wr.DirsUploaded,
+		wr.FilesUnreadable, wr.DirsUnreadable,
+		wr.FilesInconsistent,
+		wr.FilesExcluded, wr.DirsExcluded, humanize.Bytes(uint64(wr.SizeExcluded)))
 }
 
 // Add allows two WriteResult to be added.
@@ -118,6 +207,7 @@ func (wr *WriteResult) Add(wr2 *WriteResult) {
 	wr.Size += wr2.Size
 	wr.SizeSkipped += wr2.SizeSkipped
 	wr.SizeUploaded += wr2.SizeUploaded
+	wr.SizeSparse += wr2.SizeSparse
 
 	wr.BlobsCount += wr2.BlobsCount
 	wr.BlobsSkipped += wr2.BlobsSkipped
@@ -130,23 +220,39 @@ func (wr *WriteResult) Add(wr2 *WriteResult) {
 	wr.DirsCount += wr2.DirsCount
 	wr.DirsSkipped += wr2.DirsSkipped
 	wr.DirsUploaded += wr2.DirsUploaded
+
+	wr.FilesUnreadable += wr2.FilesUnreadable
+	wr.DirsUnreadable += wr2.DirsUnreadable
+	wr.Errors = append(wr.Errors, wr2.Errors...)
+
+	wr.FilesInconsistent += wr2.FilesInconsistent
+	wr.Inconsistent = append(wr.Inconsistent, wr2.Inconsistent...)
+
+	wr.FilesExcluded += wr2.FilesExcluded
+	wr.DirsExcluded += wr2.DirsExcluded
+	wr.SizeExcluded += wr2.SizeExcluded
+	wr.Excluded = append(wr.Excluded, wr2.Excluded...)
 }
 
 // a ReadResult keeps track of the number/size of downloaded blobs.
 type ReadResult struct {
-	Hash string
+	Hash string `json:"hash"`
 
-	Size           int
-	SizeDownloaded int
+	Size           int `json:"size"`
+	SizeDownloaded int `json:"size_downloaded"`
 
-	BlobsCount      int
-	BlobsDownloaded int
+	BlobsCount      int `json:"blobs_count"`
+	BlobsDownloaded int `json:"blobs_downloaded"`
 
-	FilesCount      int
-	FilesDownloaded int
+	FilesCount      int `json:"files_count"`
+	FilesDownloaded int `json:"files_downloaded"`
+	// FilesSkipped/FilesKept are the existing files left untouched when resuming a restore
+	// (already restored, or conflicting and kept)
+	FilesSkipped int `json:"files_skipped"`
+	FilesKept    int `json:"files_kept"`
 
-	DirsCount      int
-	DirsDownloaded int
+	DirsCount      int `json:"dirs_count"`
+	DirsDownloaded int `json:"dirs_downloaded"`
 }
 
 // Add allow two ReadResult to be added.
@@ -159,6 +265,8 @@ func (rr *ReadResult) Add(rr2 *ReadResult) {
 
 	rr.FilesCount += rr2.FilesCount
 	rr.FilesDownloaded += rr2.FilesDownloaded
+	rr.FilesSkipped += rr2.FilesSkipped
+	rr.FilesKept += rr2.FilesKept
 
 	rr.DirsCount += rr2.DirsCount
 	rr.DirsDownloaded += rr2.DirsDownloaded
@@ -0,0 +1,34 @@
+package clientutil
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestWriteResultJSON(t *testing.T) {
+	wr := &WriteResult{Hash: "abcd", Size: 10, SizeUploaded: 8, FilesCount: 2, AlreadyExists: true}
+	js, err := json.Marshal(wr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"hash":"abcd"`, `"size_uploaded":8`, `"files_count":2`, `"already_exists":true`} {
+		if !strings.Contains(string(js), field) {
+			t.Errorf("%s: missing %v", js, field)
+		}
+	}
+	for _, js := range []string{
+		string(js),
+		// Saved by older versions
+		`{"Hash":"abcd","Size":10,"SizeUploaded":8,"FilesCount":2,"AlreadyExists":true}`,
+	} {
+		wr2 := &WriteResult{}
+		if err := json.Unmarshal([]byte(js), wr2); err != nil {
+			t.Fatal(err)
+		}
+		if wr2.Hash != wr.Hash || wr2.Size != wr.Size || wr2.SizeUploaded != wr.SizeUploaded ||
+			wr2.FilesCount != wr.FilesCount || !wr2.AlreadyExists {
+			t.Errorf("%v: got %+v", js, wr2)
+		}
+	}
+}
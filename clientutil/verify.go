@@ -0,0 +1,68 @@
+package clientutil
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/dchest/blake2b"
+	"github.com/tsileo/blobstash/client/interface"
+)
+
+// Verify fetches every blobs of the file/directory referenced by key,
+// and checks that the size of each file matches its Meta.
+func Verify(bs client.BlobStorer, key string) (*ReadResult, error) {
+	rr := &ReadResult{}
+	meta, err := NewMetaFromBlobStore(bs, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch meta %v: %v", key, err)
+	}
+	if meta.IsFile() {
+		h := blake2b.New256()
+		ffile, err := NewFakeFile(bs, meta)
+		if err != nil {
+			return nil, err
+		}
+		defer ffile.Close()
+		n, err := io.Copy(ioutil.Discard, io.TeeReader(ffile, h))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file %v: %v", key, err)
+		}
+		rr.Hash = fmt.Sprintf("%x", h.Sum(nil))
+		rr.Size = int(n)
+		rr.SizeDownloaded = rr.Size
+		// Holes are not stored
+		for _, iv := range ffile.lmrange {
+			if iv.Value != "" {
+				rr.BlobsCount++
+				rr.BlobsDownloaded++
+			}
+		}
+		rr.FilesCount++
+		rr.FilesDownloaded++
+		if rr.Size != meta.Size {
+			return rr, fmt.Errorf("file %v (%v) is corrupted, size:%v/expected size:%v",
+				meta.Name, key, rr.Size, meta.Size)
+		}
+		return rr, nil
+	}
+	fullHash := blake2b.New256()
+	for _, ref := range meta.Refs {
+		hash, ok := ref.(string)
+		if !ok {
+			return rr, fmt.Errorf("dir %v (%v): unexpected ref %v", meta.Name, key, ref)
+		}
+		crr, err := Verify(bs, hash)
+		if crr != nil {
+			rr.Add(crr)
+		}
+		if err != nil {
+			return rr, err
+		}
+		fullHash.Write([]byte(crr.Hash))
+	}
+	rr.DirsCount++
+	rr.DirsDownloaded++
+	rr.Hash = fmt.Sprintf("%x", fullHash.Sum(nil))
+	return rr, nil
+}
@@ -0,0 +1,25 @@
+package clientutil
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	s := newMemStore()
+	root := s.putDir(t, "root", 0755, s.putFile(t, "a.txt", 0644, "hello ", "world"))
+	rr, err := Verify(s, root.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.FilesCount != 1 || rr.DirsCount != 1 || rr.BlobsCount != 2 || rr.Size != len("hello world") {
+		t.Errorf("unexpected result %+v", rr)
+	}
+
+	// A malformed meta must not crash the verification
+	bad := &Meta{Name: "bad", Type: "dir", Version: "1", Refs: []interface{}{[]interface{}{1, "abcd"}}}
+	s.putMeta(t, bad)
+	if _, err := Verify(s, bad.Hash); err == nil || !strings.Contains(err.Error(), "unexpected ref") {
+		t.Errorf("expected an unexpected ref error, got %v", err)
+	}
+}
@@ -2,14 +2,23 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
 
 	"github.com/codegangsta/cli"
+	"golang.org/x/net/context"
 
+	"github.com/tsileo/blobsnap/clientutil"
 	"github.com/tsileo/blobsnap/fs"
+	"github.com/tsileo/blobsnap/fssnap"
 	"github.com/tsileo/blobsnap/scheduler"
 	"github.com/tsileo/blobsnap/snapshot"
+	"github.com/tsileo/blobsnap/web"
+	"github.com/tsileo/blobstash/client"
 )
 
 var version = "dev"
@@ -17,30 +26,380 @@ var version = "dev"
 func main() {
 	app := cli.NewApp()
 	commonFlags := []cli.Flag{
-		cli.StringFlag{"host", "", "override the real hostname"},
+		cli.StringFlag{"server", "", "BlobStash server address"},
+		cli.StringFlag{"hostname", "", "override the real hostname"},
+		cli.StringFlag{"host", "", "override the real hostname (deprecated, use --hostname)"},
 		cli.StringFlag{"config", "", "config file"},
 	}
 	app.Name = "blobsnap"
 	app.Usage = "BlobSnap command-line tool"
 	app.Version = version
+	tagFlag := cli.StringSliceFlag{"tag", &cli.StringSlice{}, "filter by tag (key=value), can be repeated"}
+	app.Flags = []cli.Flag{
+		cli.BoolFlag{"json", "output JSON objects instead of text"},
+	}
 	app.Commands = []cli.Command{
 		{
 			Name:  "put",
-			Usage: "Upload a file/directory",
-			Flags: commonFlags,
+			Usage: "Upload a file/directory, several paths as a single snapshot (or stdin with --stdin)",
+			Flags: append([]cli.Flag{
+				cli.BoolFlag{"stdin", "upload stdin instead of a file/directory (requires --name)"},
+				cli.StringFlag{"exec", "", "run the command and upload its output instead of a file/directory (requires --name)"},
+				cli.StringFlag{"name", "", "file name used when uploading stdin or the command output (or name of a multi-paths snapshot)"},
+				cli.StringFlag{"pre", "", "command to run before the snapshot"},
+				cli.StringFlag{"post", "", "command to run after the upload (before the snapshot is saved), also run if the upload fails once the pre command has run"},
+				cli.StringFlag{"on-failure", "", "command to run if the snapshot fails"},
+				cli.StringFlag{"hook-timeout", "", "timeout for each hook command (e.g. 5m)"},
+				cli.StringFlag{"hook-error", "abort", "what to do when the pre/post command fails: abort or mark"},
+				cli.StringFlag{"comment", "", "comment stored in the snapshot"},
+				cli.StringSliceFlag{"tag", &cli.StringSlice{}, "tag (key=value) stored in the snapshot, can be repeated"},
+				cli.StringFlag{"timeout", "", "abort the snapshot if it takes longer (e.g. 2h)"},
+				cli.BoolFlag{"strict", "fail instead of skipping unreadable/vanished files"},
+				cli.IntFlag{"changed-retries", 3, "number of retries for files modified during the upload"},
+				cli.StringFlag{"fs-snapshot", "", "backup from a filesystem snapshot: btrfs, lvm or copy"},
+				cli.StringSliceFlag{"exclude", &cli.StringSlice{}, "exclude the paths matching the pattern (.gitignore syntax), can be repeated"},
+				cli.StringSliceFlag{"include", &cli.StringSlice{}, "never exclude the paths matching the pattern, can be repeated"},
+				cli.BoolFlag{"gitignore", "honor .gitignore files"},
+				cli.BoolFlag{"exclude-caches", "exclude directories containing a CACHEDIR.TAG file"},
+				cli.BoolFlag{"one-file-system", "don't cross filesystem boundaries"},
+				cli.BoolFlag{"record-excluded", "store the excluded paths in the snapshot"},
+				cli.BoolFlag{"sparse", "store the regions of zeros of the files as holes (e.g. for VM images), restored as sparse files"},
+				cli.BoolFlag{"explain-excludes", "list the excluded paths and the rule excluding them, without uploading anything"},
+			}, commonFlags...),
 			Action: func(c *cli.Context) {
-				up, err := snapshot.NewUploader(c.String("host"))
+				tags, err := snapshot.ParseTags(c.StringSlice("tag"))
+				if err != nil {
+					fatal(c, "put", "%v", err)
+				}
+				if (c.Bool("stdin") || c.String("exec") != "") && c.String("name") == "" {
+					fatal(c, "put", "--stdin and --exec requires a file name (--name)")
+				}
+				if provider := c.String("fs-snapshot"); provider != "" {
+					if c.Bool("stdin") || c.String("exec") != "" {
+						fatal(c, "put", "--fs-snapshot can't be used with --stdin or --exec")
+					}
+					if _, err := fssnap.Get(provider); err != nil {
+						fatal(c, "put", "%v", err)
+					}
+				}
+				excludes := &clientutil.Excludes{
+					Exclude:       c.StringSlice("exclude"),
+					Include:       c.StringSlice("include"),
+					GitIgnore:     c.Bool("gitignore"),
+					ExcludeCaches: c.Bool("exclude-caches"),
+					OneFileSystem: c.Bool("one-file-system"),
+				}
+				if c.Bool("explain-excludes") {
+					if c.Bool("stdin") || c.String("exec") != "" {
+						fatal(c, "put", "--explain-excludes can't be used with --stdin or --exec")
+					}
+					excluded := []*clientutil.ExcludedPath{}
+					for _, path := range c.Args() {
+						pexcluded, err := clientutil.ExplainExcludes(path, excludes)
+						if err != nil {
+							fatal(c, "put", "%v", err)
+						}
+						excluded = append(excluded, pexcluded...)
+					}
+					if c.GlobalBool("json") {
+						printJSON(&explainOutput{Excluded: excluded})
+						return
+					}
+					printExcluded(excluded)
+					return
+				}
+				hooks := &snapshot.Hooks{
+					Pre:       c.String("pre"),
+					Post:      c.String("post"),
+					OnFailure: c.String("on-failure"),
+					Timeout:   c.String("hook-timeout"),
+					OnError:   c.String("hook-error"),
+				}
+				if err := hooks.Validate(); err != nil {
+					fatal(c, "put", "%v", err)
+				}
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				if t := c.String("timeout"); t != "" {
+					timeout, err := time.ParseDuration(t)
+					if err != nil {
+						fatal(c, "put", "invalid timeout %q: %v", t, err)
+					}
+					ctx, cancel = context.WithTimeout(ctx, timeout)
+					defer cancel()
+				}
+				// Cancel the upload on Ctrl+C, a second one kills the process
+				sigs := make(chan os.Signal, 1)
+				signal.Notify(sigs, os.Interrupt)
+				go func() {
+					<-sigs
+					log.Println("Interrupted, canceling the snapshot...")
+					signal.Stop(sigs)
+					cancel()
+				}()
+				up, err := snapshot.NewUploader(c.String("server"))
 				defer up.Close()
 				if err != nil {
-					log.Fatalf("failed to initialize uploader: %v", err)
+					fatal(c, "put", "failed to initialize uploader: %v", err)
+				}
+				up.Hostname = hostname(c)
+				up.Uploader.Strict = c.Bool("strict")
+				up.Uploader.ChangedRetries = c.Int("changed-retries")
+				opts := &snapshot.PutOptions{
+					Comment: c.String("comment"),
+					Tags:    tags,
+					Hooks:   hooks,
+
+					FSSnapshot:     c.String("fs-snapshot"),
+					Excludes:       excludes,
+					RecordExcluded: c.Bool("record-excluded"),
+					Sparse:         c.Bool("sparse"),
+				}
+				var snap *snapshot.Snapshot
+				var meta *clientutil.Meta
+				switch {
+				case c.Bool("stdin"):
+					snap, meta, err = up.PutReaderContext(ctx, c.String("name"), os.Stdin, opts)
+				case c.String("exec") != "":
+					snap, meta, err = up.PutCommandContext(ctx, c.String("name"), c.String("exec"), opts)
+				case len(c.Args()) > 1:
+					snap, meta, err = up.PutPathsContext(ctx, c.String("name"), c.Args(), opts)
+				default:
+					snap, meta, err = up.PutContext(ctx, c.Args().First(), opts)
 				}
-				meta, err := up.Put(c.Args().First())
 				if err != nil {
-					log.Fatalf("snapshot failed: %v", err)
+					fatal(c, "put", "snapshot failed: %v", err)
+				}
+				if c.GlobalBool("json") {
+					printJSON(&putOutput{Snapshot: snap, Created: snap.Created})
+					return
+				}
+				for _, serr := range snap.Errors {
+					log.Printf("skipped %v", serr)
+				}
+				for _, path := range snap.Inconsistent {
+					log.Printf("%v was modified during the upload and may be inconsistent", path)
 				}
 				fmt.Printf("%v", meta.Hash)
 			},
 		},
+		{
+			Name:  "import",
+			Usage: "Create a snapshot from a tar archive (optionally gzip'ed), or from stdin with \"-\"",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{"name", "", "archive name recorded in the snapshot path (defaults to the file name, required with stdin)"},
+				cli.StringFlag{"comment", "", "comment stored in the snapshot"},
+				cli.StringSliceFlag{"tag", &cli.StringSlice{}, "tag (key=value) stored in the snapshot, can be repeated"},
+				cli.BoolFlag{"sparse", "store the regions of zeros of the files as holes"},
+			}, commonFlags...),
+			Action: func(c *cli.Context) {
+				archive := c.Args().First()
+				if archive == "" {
+					fatal(c, "import", "usage: blobsnap import <archive|->")
+				}
+				tags, err := snapshot.ParseTags(c.StringSlice("tag"))
+				if err != nil {
+					fatal(c, "import", "%v", err)
+				}
+				name := c.String("name")
+				var r io.Reader = os.Stdin
+				if archive != "-" {
+					f, err := os.Open(archive)
+					if err != nil {
+						fatal(c, "import", "%v", err)
+					}
+					defer f.Close()
+					r = f
+					if name == "" {
+						name = filepath.Base(archive)
+					}
+				}
+				if name == "" {
+					fatal(c, "import", "importing from stdin requires an archive name (--name)")
+				}
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				// Cancel the import on Ctrl+C, a second one kills the process
+				sigs := make(chan os.Signal, 1)
+				signal.Notify(sigs, os.Interrupt)
+				go func() {
+					<-sigs
+					log.Println("Interrupted, canceling the import...")
+					signal.Stop(sigs)
+					cancel()
+				}()
+				up, err := snapshot.NewUploader(c.String("server"))
+				defer up.Close()
+				if err != nil {
+					fatal(c, "import", "failed to initialize uploader: %v", err)
+				}
+				up.Hostname = hostname(c)
+				snap, meta, err := up.PutTarContext(ctx, name, r, &snapshot.PutOptions{
+					Comment: c.String("comment"),
+					Tags:    tags,
+					Sparse:  c.Bool("sparse"),
+				})
+				if err != nil {
+					fatal(c, "import", "import failed: %v", err)
+				}
+				if c.GlobalBool("json") {
+					printJSON(&putOutput{Snapshot: snap, Created: snap.Created})
+					return
+				}
+				fmt.Printf("%v", meta.Hash)
+			},
+		},
+		{
+			Name:  "ls",
+			Usage: "List snapshots, or the versions of the given snapset key",
+			Flags: append([]cli.Flag{tagFlag}, commonFlags...),
+			Action: func(c *cli.Context) {
+				kvs := client.NewKvStore(c.String("server"))
+				var snaps []*snapshot.Snapshot
+				var err error
+				if key := c.Args().First(); key != "" {
+					snaps, err = snapshot.Versions(kvs, key)
+				} else {
+					snaps, err = snapshot.SnapSets(kvs)
+				}
+				if err != nil {
+					fatal(c, "ls", "failed to list snapshots: %v", err)
+				}
+				snaps = filterSnapshots(c, "ls", snaps)
+				if c.GlobalBool("json") {
+					printJSON(&lsOutput{Snapshots: snaps})
+					return
+				}
+				printSnapshots(snaps)
+			},
+		},
+		{
+			Name:  "restore",
+			Usage: "Restore the snapshot ref (or the latest version of the snapset key) to the given path",
+			Flags: append([]cli.Flag{
+				tagFlag,
+				cli.StringFlag{"root", "", "only restore this path of the snapshot (e.g. one of the paths of a multi-paths snapshot)"},
+				cli.StringSliceFlag{"include", &cli.StringSlice{}, "only restore the paths matching the glob pattern (relative to the snapshot root), can be repeated"},
+				cli.StringSliceFlag{"exclude", &cli.StringSlice{}, "don't restore the paths matching the glob pattern, can be repeated"},
+				cli.IntFlag{"strip-components", 0, "strip the given number of leading components from the restored paths"},
+				cli.BoolFlag{"resume", "restore into an existing directory, skipping the files already restored (same size and mtime)"},
+				cli.BoolFlag{"check-hash", "with --resume, also compare the content of the existing files"},
+				cli.StringFlag{"conflict", "overwrite", "with --resume, what to do with existing files that don't match: overwrite, keep or fail"},
+			}, commonFlags...),
+			Action: func(c *cli.Context) {
+				ref, path := c.Args().First(), c.Args().Get(1)
+				if ref == "" || path == "" {
+					fatal(c, "restore", "usage: blobsnap restore <ref|key> <path>")
+				}
+				ref = resolveRef(c, "restore", client.NewKvStore(c.String("server")), ref)
+				bs := client.NewBlobStore(c.String("server"))
+				if root := c.String("root"); root != "" {
+					meta, err := clientutil.Lookup(bs, ref, root)
+					if err != nil {
+						fatal(c, "restore", "%v", err)
+					}
+					ref = meta.Hash
+				}
+				rr, err := clientutil.RestoreWithOptions(bs, ref, path, &clientutil.RestoreOptions{
+					Include:         c.StringSlice("include"),
+					Exclude:         c.StringSlice("exclude"),
+					StripComponents: c.Int("strip-components"),
+					Resume:          c.Bool("resume"),
+					CheckHash:       c.Bool("check-hash"),
+					Conflict:        c.String("conflict"),
+				})
+				if err != nil {
+					fatal(c, "restore", "restore failed: %v", err)
+				}
+				if c.GlobalBool("json") {
+					printJSON(&readOutput{Ref: ref, Path: path, ReadResult: rr})
+					return
+				}
+				if rr.FilesSkipped > 0 || rr.FilesKept > 0 {
+					log.Printf("%d files already restored, %d conflicting files kept", rr.FilesSkipped, rr.FilesKept)
+				}
+				log.Printf("%v restored to %v", ref, path)
+			},
+		},
+		{
+			Name:  "verify",
+			Usage: "Fetch every blobs of the snapshot ref and check its integrity",
+			Flags: commonFlags,
+			Action: func(c *cli.Context) {
+				ref := c.Args().First()
+				if ref == "" {
+					fatal(c, "verify", "usage: blobsnap verify <ref>")
+				}
+				bs := client.NewBlobStore(c.String("server"))
+				rr, err := clientutil.Verify(bs, ref)
+				if err != nil {
+					fatal(c, "verify", "verify failed: %v", err)
+				}
+				if c.GlobalBool("json") {
+					printJSON(&readOutput{Ref: ref, ReadResult: rr})
+					return
+				}
+				log.Printf("%v verified (%v files, %v dirs)", ref, rr.FilesCount, rr.DirsCount)
+			},
+		},
+		{
+			Name:  "export",
+			Usage: "Write the snapshot ref (or the latest version of the snapset key) as a tar/zip archive to stdout (or to a file)",
+			Flags: append([]cli.Flag{
+				tagFlag,
+				cli.StringFlag{"root", "", "only export this path of the snapshot"},
+				cli.StringFlag{"format", "", "archive format: tar, tar.gz or zip (guessed from --output, tar by default)"},
+				cli.StringFlag{"output", "", "write the archive to this file instead of stdout"},
+			}, commonFlags...),
+			Action: func(c *cli.Context) {
+				ref := c.Args().First()
+				if ref == "" {
+					fatal(c, "export", "usage: blobsnap export <ref|key>")
+				}
+				ref = resolveRef(c, "export", client.NewKvStore(c.String("server")), ref)
+				bs := client.NewBlobStore(c.String("server"))
+				if root := c.String("root"); root != "" {
+					meta, err := clientutil.Lookup(bs, ref, root)
+					if err != nil {
+						fatal(c, "export", "%v", err)
+					}
+					ref = meta.Hash
+				}
+				output := c.String("output")
+				format := c.String("format")
+				if format == "" {
+					format = clientutil.ArchiveFormat(output)
+				}
+				var w io.Writer = os.Stdout
+				var f *os.File
+				if output != "" {
+					var err error
+					if f, err = os.Create(output); err != nil {
+						fatal(c, "export", "%v", err)
+					}
+					w = f
+				}
+				rr, err := clientutil.Export(bs, ref, w, format)
+				// Closed explicitly (fatal skips the defers), the archive may be incomplete if it fails
+				if f != nil {
+					if cerr := f.Close(); err == nil {
+						err = cerr
+					}
+				}
+				if err != nil {
+					if output != "" {
+						os.Remove(output)
+					}
+					fatal(c, "export", "export failed: %v", err)
+				}
+				// The JSON output would be mixed with the archive on stdout
+				if c.GlobalBool("json") && output != "" {
+					printJSON(&readOutput{Ref: ref, Path: output, ReadResult: rr})
+					return
+				}
+				log.Printf("%v exported (%v files, %v dirs)", ref, rr.FilesCount, rr.DirsCount)
+			},
+		},
 		{
 			Name:  "mount",
 			Usage: "Mount the read-only filesystem to the given path",
@@ -48,21 +407,81 @@ func main() {
 			Action: func(c *cli.Context) {
 				stop := make(chan bool, 1)
 				stopped := make(chan bool, 1)
-				fs.Mount(c.String("host"), c.Args().First(), stop, stopped)
+				fs.Mount(c.String("server"), c.Args().First(), stop, stopped)
+			},
+		},
+		{
+			Name:  "serve",
+			Usage: "Serve a read-only web UI (and JSON API) to browse and download the snapshots",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{"listen", "127.0.0.1:8060", "address to listen on"},
+			}, commonFlags...),
+			Action: func(c *cli.Context) {
+				if err := web.New(c.String("server")).ListenAndServe(c.String("listen")); err != nil {
+					fatal(c, "serve", "%v", err)
+				}
 			},
 		},
 		{
 			Name:      "scheduler",
 			ShortName: "sched",
-			Usage:     "Start the backup scheduler",
-			Flags:     commonFlags,
+			Usage:     "Start the backup scheduler (or display the jobs state/history with `sched status` and `sched history [key]`)",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{"db", "", "scheduler state database path"},
+			}, commonFlags...),
 			Action: func(c *cli.Context) {
-				up, _ := snapshot.NewUploader(c.Args().First())
-				defer up.Close()
-				d := scheduler.New(up)
-				d.Run()
+				switch c.Args().First() {
+				case "":
+				case "status":
+					jobs, err := scheduler.Status(c.String("db"))
+					if err != nil {
+						fatal(c, "sched", "failed to read the scheduler db: %v", err)
+					}
+					if c.GlobalBool("json") {
+						printJSON(&schedStatusOutput{Jobs: jobs})
+						return
+					}
+					printJobs(jobs)
+					return
+				case "history":
+					results, err := scheduler.History(c.String("db"), c.Args().Get(1))
+					if err != nil {
+						fatal(c, "sched", "failed to read the scheduler db: %v", err)
+					}
+					if c.GlobalBool("json") {
+						printJSON(&schedHistoryOutput{Results: results})
+						return
+					}
+					printHistory(results)
+					return
+				default:
+					fatal(c, "sched", "unknown sched command %q", c.Args().First())
+				}
+				// The uploader is closed by the scheduler on shutdown
+				up, _ := snapshot.NewUploader(c.String("server"))
+				up.Hostname = hostname(c)
+				d, err := scheduler.New(up, c.String("config"), c.String("db"))
+				if err != nil {
+					fatal(c, "sched", "failed to initialize scheduler: %v", err)
+				}
+				if c.GlobalBool("json") {
+					d.OnResult = func(res *scheduler.JobResult) {
+						printJSON(res)
+					}
+				}
+				if err := d.Run(); err != nil {
+					fatal(c, "sched", "%v", err)
+				}
 			},
 		},
 	}
 	app.Run(os.Args)
 }
+
+// hostname returns the hostname override given with --hostname (or the legacy --host).
+func hostname(c *cli.Context) string {
+	if h := c.String("hostname"); h != "" {
+		return h
+	}
+	return c.String("host")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/dustin/go-humanize"
+
+	"github.com/tsileo/blobsnap/clientutil"
+	"github.com/tsileo/blobsnap/scheduler"
+	"github.com/tsileo/blobsnap/snapshot"
+	"github.com/tsileo/blobstash/client"
+)
+
+// Objects written to stdout when the global --json flag is set,
+// field names are part of the CLI API and must stay stable.
+
+type errorOutput struct {
+	Command string `json:"command"`
+	Error   string `json:"error"`
+}
+
+type putOutput struct {
+	Snapshot *snapshot.Snapshot `json:"snapshot"`
+	Created  bool               `json:"created"`
+}
+
+type explainOutput struct {
+	Excluded []*clientutil.ExcludedPath `json:"excluded"`
+}
+
+type lsOutput struct {
+	Snapshots []*snapshot.Snapshot `json:"snapshots"`
+}
+
+type readOutput struct {
+	Ref        string                 `json:"ref"`
+	Path       string                 `json:"path,omitempty"`
+	ReadResult *clientutil.ReadResult `json:"rr"`
+}
+
+type schedStatusOutput struct {
+	Jobs []*scheduler.JobStatus `json:"jobs"`
+}
+
+type schedHistoryOutput struct {
+	Results []*scheduler.JobResult `json:"results"`
+}
+
+// printJSON writes v as a single line of JSON to stdout.
+func printJSON(v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		log.Fatalf("failed to marshal output: %v", err)
+	}
+	fmt.Printf("%s\n", js)
+}
+
+// fatal reports the error (as an error object if --json is set) and exits.
+func fatal(c *cli.Context, command, format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	if c.GlobalBool("json") {
+		printJSON(&errorOutput{Command: command, Error: msg})
+		os.Exit(1)
+	}
+	log.Fatal(msg)
+}
+
+// filterSnapshots returns the snapshots matching the tags given with --tag.
+func filterSnapshots(c *cli.Context, command string, snaps []*snapshot.Snapshot) []*snapshot.Snapshot {
+	tags, err := snapshot.ParseTags(c.StringSlice("tag"))
+	if err != nil {
+		fatal(c, command, "%v", err)
+	}
+	res := []*snapshot.Snapshot{}
+	for _, snap := range snaps {
+		if snap.MatchTags(tags) {
+			res = append(res, snap)
+		}
+	}
+	return res
+}
+
+// resolveRef returns the meta ref to restore, arg is either a ref, or a snapset key
+// (the latest version matching the tags given with --tag is used), "key:<key>" is always a snapset key.
+func resolveRef(c *cli.Context, command string, kvs *client.KvStore, arg string) string {
+	tags, err := snapshot.ParseTags(c.StringSlice("tag"))
+	if err != nil {
+		fatal(c, command, "%v", err)
+	}
+	key := strings.TrimPrefix(arg, "key:")
+	isKey := key != arg || len(tags) > 0
+	snap, err := snapshot.Latest(kvs, key, tags)
+	if err != nil {
+		if isKey {
+			fatal(c, command, "failed to fetch snapset %v: %v", key, err)
+		}
+		// The kv store is only needed for the snapset keys
+		log.Printf("failed to fetch snapset %v, using it as a ref: %v", arg, err)
+		return arg
+	}
+	if snap != nil {
+		return snap.Ref
+	}
+	if isKey {
+		fatal(c, command, "no snapshot matching the tags in snapset %v", key)
+	}
+	return arg
+}
+
+// printSnapshots displays the snapshots as a table.
+func printSnapshots(snaps []*snapshot.Snapshot) {
+	for _, snap := range snaps {
+		t := time.Unix(int64(snap.Time), 0).Format(time.RFC3339)
+		fmt.Printf("%v\t%v\t%v\t%v\t%v", t, snap.Hostname, snap.Path, snap.Ref, snap.SnapSetKey)
+		if tags := snap.TagList(); len(tags) > 0 {
+			fmt.Printf("\t[%v]", strings.Join(tags, " "))
+		}
+		if snap.Comment != "" {
+			fmt.Printf("\t%q", snap.Comment)
+		}
+		if snap.Partial {
+			fmt.Printf("\t(partial)")
+		}
+		if len(snap.Inconsistent) > 0 {
+			fmt.Printf("\t(%v inconsistent files)", len(snap.Inconsistent))
+		}
+		fmt.Printf("\n")
+	}
+}
+
+// printExcluded displays the excluded paths, and the rule excluding them.
+func printExcluded(excluded []*clientutil.ExcludedPath) {
+	total := 0
+	for _, e := range excluded {
+		fmt.Printf("%v\t%v\t%v\n", e.Path, humanize.Bytes(uint64(e.Size)), e.Reason)
+		total += e.Size
+	}
+	fmt.Printf("%v paths excluded (%v)\n", len(excluded), humanize.Bytes(uint64(total)))
+}
+
+// printJobs displays the scheduler jobs state.
+func printJobs(jobs []*scheduler.JobStatus) {
+	for _, job := range jobs {
+		fmt.Printf("%v\n  spec: %v\n  prev: %v\n  next: %v\n", job.Key, job.Spec, fmtTime(job.Prev), fmtTime(job.Next))
+		res := job.LastResult
+		if res == nil {
+			fmt.Printf("  last result: -\n")
+			continue
+		}
+		switch {
+		case res.Error != "":
+			fmt.Printf("  last result: failed at %v\n  last error: %v\n", fmtTime(res.End), res.Error)
+		case res.Snapshot != nil:
+			fmt.Printf("  last result: %v at %v (%v)\n", res.Snapshot.Ref, fmtTime(res.End), res.End.Sub(res.Start))
+		default:
+			fmt.Printf("  last result: done at %v\n", fmtTime(res.End))
+		}
+	}
+}
+
+// printHistory displays the scheduler jobs results.
+func printHistory(results []*scheduler.JobResult) {
+	for _, res := range results {
+		status := res.Ref
+		if res.Error != "" {
+			status = fmt.Sprintf("failed: %v", res.Error)
+		}
+		fmt.Printf("%v\t%v\t%v\t%d attempt(s)\t%v\n", fmtTime(res.Start), res.Key, res.Duration, res.Attempts, status)
+	}
+}
+
+func fmtTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
@@ -8,6 +8,8 @@ The root directory contains two specials directory:
 - **snapshots**, it contains a list of directory with the file/dir name, and inside this directory,
 a list of directory: one directory per snapshots, and finally inside this dir,
 the file/dir (e.g /datadb/mnt/snapshots/writing/2014-05-04T17:42:48+02:00/writing).
+- **tags**, it contains one directory per tag (key=value), with the same layout as **snapshots**,
+but only with the tagged snapshots (e.g. /datadb/mnt/tags/env=prod/writing/2014-05-04T17:42:48+02:00/writing).
 
 */
 package fs
@@ -43,6 +45,8 @@ const (
 	HostSnapshots
 	SnapshotDir
 	SnapshotsDir
+	HostTags
+	TagDir
 )
 
 func (dt DirType) String() string {
@@ -62,6 +66,10 @@ func (dt DirType) String() string {
 		return "SnapshotsDir"
 	case SnapshotDir:
 		return "SnapshotDir"
+	case HostTags:
+		return "HostTags"
+	case TagDir:
+		return "TagDir"
 	}
 	return ""
 }
@@ -128,22 +136,19 @@ func NewFS(server string) (fs *FS) {
 		SnapSets: map[string][]*snapshot.Snapshot{},
 	}
 	if err := fs.Reload(); err != nil {
-		panic(err)
+		// Not fatal, the snapshots are reloaded when listing directories
+		log.Printf("failed to load snapshots: %v", err)
 	}
 	return
 }
 func (fs *FS) Reload() error {
 	fs.Hosts = []string{}
 	fs.SnapSets = map[string][]*snapshot.Snapshot{}
-	keys, err := fs.kvs.Keys("blobsnap:snapset:", "blobsnap:snapset:\xff", 0)
+	snaps, err := snapshot.SnapSets(fs.kvs)
 	if err != nil {
-		return fmt.Errorf("failed kvs.Keys: %v", err)
+		return err
 	}
-	for _, kv := range keys {
-		snapshot := &snapshot.Snapshot{}
-		if err := json.Unmarshal([]byte(kv.Value), snapshot); err != nil {
-			return fmt.Errorf("failed to unmarshal: %v", err)
-		}
+	for _, snapshot := range snaps {
 		_, ok := fs.SnapSets[snapshot.Hostname]
 		if !ok {
 			fs.Hosts = append(fs.Hosts, snapshot.Hostname)
@@ -153,6 +158,18 @@ func (fs *FS) Reload() error {
 	return nil
 }
 
+// fuseError logs the error and converts it to a FUSE error (fuse.EIO unless it's already a FUSE error).
+func fuseError(op string, n interface{}, err error) error {
+	if err == nil {
+		return nil
+	}
+	if ferr, ok := err.(fuse.Errno); ok {
+		return ferr
+	}
+	log.Printf("%v %+v failed: %v", op, n, err)
+	return fuse.EIO
+}
+
 func (fs *FS) Root() (fs.Node, error) {
 	return NewRootDir(fs), nil
 }
@@ -200,7 +217,8 @@ func (d *Dir) Attr(a *fuse.Attr) {
 	if d.ModTime != "" {
 		t, err := time.Parse(time.RFC3339, d.ModTime)
 		if err != nil {
-			panic(fmt.Errorf("error parsing mtime for %v: %v", d, err))
+			log.Printf("error parsing mtime for %v: %v", d, err)
+			return
 		}
 		a.Mtime = t
 	}
@@ -209,21 +227,25 @@ func (d *Dir) Attr(a *fuse.Attr) {
 func (d *Dir) readDir() (out []fuse.Dirent, ferr error) {
 	meta, err := clientutil.NewMetaFromBlobStore(d.fs.bs, d.Ref)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to fetch meta: %v", err)
 	}
 	if meta.Size > 0 {
-		for _, hash := range meta.Refs {
-			meta, err := clientutil.NewMetaFromBlobStore(d.fs.bs, hash.(string))
+		for _, ref := range meta.Refs {
+			hash, ok := ref.(string)
+			if !ok {
+				return nil, fmt.Errorf("dir %v (%v): unexpected ref %v", meta.Name, d.Ref, ref)
+			}
+			meta, err := clientutil.NewMetaFromBlobStore(d.fs.bs, hash)
 			if err != nil {
 				return nil, fmt.Errorf("failed to fetch meta: %v", err)
 			}
 			var dirent fuse.Dirent
 			if meta.Type == "file" {
 				dirent = fuse.Dirent{Name: meta.Name, Type: fuse.DT_File}
-				d.Children[meta.Name] = NewFile(d.fs, meta.Name, hash.(string), meta.Size, meta.ModTime, os.FileMode(meta.Mode))
+				d.Children[meta.Name] = NewFile(d.fs, meta.Name, hash, meta.Size, meta.ModTime, os.FileMode(meta.Mode))
 			} else {
 				dirent = fuse.Dirent{Name: meta.Name, Type: fuse.DT_Dir}
-				d.Children[meta.Name] = NewDir(d.fs, BasicDir, meta.Name, hash.(string), meta.ModTime, os.FileMode(meta.Mode), "")
+				d.Children[meta.Name] = NewDir(d.fs, BasicDir, meta.Name, hash, meta.ModTime, os.FileMode(meta.Mode), "")
 			}
 			out = append(out, dirent)
 		}
@@ -235,7 +257,9 @@ func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	log.Printf("OP Lookup %v", name)
 	log.Printf("DEBUG %+v", d)
 	if len(d.Children) == 0 {
-		d.loadDir()
+		if _, err := d.loadDir(); err != nil {
+			return nil, fuseError("Lookup", d, err)
+		}
 	}
 	log.Printf("DEBUG %+v", d)
 	fs, ok := d.Children[name]
@@ -247,7 +271,11 @@ func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 
 func (d *Dir) ReadDirAll(ctx context.Context) (out []fuse.Dirent, err error) {
 	log.Printf("OP ReadDirAll %v", d)
-	return d.loadDir()
+	out, err = d.loadDir()
+	if err != nil {
+		return nil, fuseError("ReadDirAll", d, err)
+	}
+	return out, nil
 }
 
 func (d *Dir) loadDir() (out []fuse.Dirent, err error) {
@@ -255,7 +283,9 @@ func (d *Dir) loadDir() (out []fuse.Dirent, err error) {
 	// TODO only reload when needed
 	switch d.Type {
 	case Root:
-		d.fs.Reload()
+		if err := d.fs.Reload(); err != nil {
+			return nil, err
+		}
 		d.Children = make(map[string]fs.Node)
 		for _, host := range d.fs.Hosts {
 			out = append(out, fuse.Dirent{Name: host, Type: fuse.DT_Dir})
@@ -268,13 +298,17 @@ func (d *Dir) loadDir() (out []fuse.Dirent, err error) {
 		d.Children["latest"] = NewDir(d.fs, HostLatest, "latest", d.Ref, "", os.ModeDir, "")
 		out = append(out, fuse.Dirent{Name: "snapshots", Type: fuse.DT_Dir})
 		d.Children["snapshots"] = NewDir(d.fs, HostSnapshots, "snapshots", d.Ref, "", os.ModeDir, "")
+		out = append(out, fuse.Dirent{Name: "tags", Type: fuse.DT_Dir})
+		d.Children["tags"] = NewDir(d.fs, HostTags, "tags", d.Ref, "", os.ModeDir, "")
 		return out, err
 	case HostLatest:
-		d.fs.Reload()
+		if err := d.fs.Reload(); err != nil {
+			return nil, err
+		}
 		for _, snap := range d.fs.SnapSets[d.Ref] {
 			meta, err := snap.FetchMeta(d.fs.bs)
 			if err != nil {
-				panic(err)
+				return nil, fmt.Errorf("failed to fetch meta: %v", err)
 			}
 			if meta.IsFile() {
 				dirent := fuse.Dirent{Name: meta.Name, Type: fuse.DT_File}
@@ -288,7 +322,9 @@ func (d *Dir) loadDir() (out []fuse.Dirent, err error) {
 		}
 		return out, err
 	case HostSnapshots:
-		d.fs.Reload()
+		if err := d.fs.Reload(); err != nil {
+			return nil, err
+		}
 		for _, snap := range d.fs.SnapSets[d.Ref] {
 			snapName := filepath.Base(snap.Path)
 			snapHash := snap.SnapSetKey
@@ -297,15 +333,77 @@ func (d *Dir) loadDir() (out []fuse.Dirent, err error) {
 			out = append(out, dirent)
 		}
 		return out, err
+	case HostTags:
+		// One directory per "key=value" tag used by any version of the host snapsets
+		if err := d.fs.Reload(); err != nil {
+			return nil, err
+		}
+		seen := map[string]bool{}
+		for _, snap := range d.fs.SnapSets[d.Ref] {
+			versions, err := snapshot.Versions(d.fs.kvs, snap.SnapSetKey)
+			if err != nil {
+				return nil, err
+			}
+			for _, version := range versions {
+				for _, tag := range version.TagList() {
+					if seen[tag] {
+						continue
+					}
+					seen[tag] = true
+					out = append(out, fuse.Dirent{Name: tag, Type: fuse.DT_Dir})
+					if _, ok := d.Children[tag]; !ok {
+						d.Children[tag] = NewDir(d.fs, TagDir, tag, d.Ref, "", os.ModeDir, tag)
+					}
+				}
+			}
+		}
+		return out, nil
+	case TagDir:
+		// Like HostSnapshots, but only with the snapsets containing a version tagged with d.Extra
+		if err := d.fs.Reload(); err != nil {
+			return nil, err
+		}
+		k, v, err := snapshot.ParseTag(d.Extra)
+		if err != nil {
+			return nil, err
+		}
+		tags := map[string]string{k: v}
+		for _, snap := range d.fs.SnapSets[d.Ref] {
+			versions, err := snapshot.Versions(d.fs.kvs, snap.SnapSetKey)
+			if err != nil {
+				return nil, err
+			}
+			for _, version := range versions {
+				if version.MatchTags(tags) {
+					snapName := filepath.Base(snap.Path)
+					out = append(out, fuse.Dirent{Name: snapName, Type: fuse.DT_Dir})
+					d.Children[snapName] = NewDir(d.fs, SnapshotsDir, snapName, snap.SnapSetKey, "", os.ModeDir, d.Extra)
+					break
+				}
+			}
+		}
+		return out, nil
 	case SnapshotsDir:
+		// d.Extra optionally contains a "key=value" tag used to filter versions
+		tags := map[string]string{}
+		if d.Extra != "" {
+			k, v, err := snapshot.ParseTag(d.Extra)
+			if err != nil {
+				return nil, err
+			}
+			tags[k] = v
+		}
 		versions, err := d.fs.kvs.Versions(fmt.Sprintf("blobsnap:snapset:%v", d.Ref), 0, int(time.Now().UTC().UnixNano()), 0)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 		for _, kv := range versions.Versions {
 			snap := &snapshot.Snapshot{}
 			if err := json.Unmarshal([]byte(kv.Value), snap); err != nil {
-				panic(err)
+				return nil, fmt.Errorf("failed to decode snapshot %v: %v", d.Ref, err)
+			}
+			if !snap.MatchTags(tags) {
+				continue
 			}
 			stime := time.Unix(0, int64(kv.Version))
 			sname := stime.Format(time.RFC3339)
@@ -318,7 +416,7 @@ func (d *Dir) loadDir() (out []fuse.Dirent, err error) {
 	case SnapshotDir:
 		meta, err := clientutil.NewMetaFromBlobStore(d.fs.bs, d.Ref)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("failed to fetch meta: %v", err)
 		}
 		var dirent fuse.Dirent
 		if meta.IsFile() {
@@ -348,11 +446,6 @@ func NewFile(fs *FS, name string, ref string, size int, modTime string, mode os.
 	f.ModTime = modTime
 	f.Mode = mode
 	f.fs = fs
-	meta, err := clientutil.NewMetaFromBlobStore(fs.bs, ref)
-	if err != nil {
-		panic(err)
-	}
-	f.Meta = meta
 	return f
 }
 
@@ -363,7 +456,8 @@ func (f *File) Attr(a *fuse.Attr) {
 	if f.ModTime != "" {
 		t, err := time.Parse(time.RFC3339, f.ModTime)
 		if err != nil {
-			panic(fmt.Errorf("error parsing mtime for %v: %v", f, err))
+			log.Printf("error parsing mtime for %v: %v", f, err)
+			return
 		}
 		a.Mtime = t
 	}
@@ -371,7 +465,19 @@ func (f *File) Attr(a *fuse.Attr) {
 }
 
 func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, res *fuse.OpenResponse) (fs.Handle, error) {
-	f.FakeFile = clientutil.NewFakeFile(f.fs.bs, f.Meta)
+	// The Meta is fetched on the first open
+	if f.Meta == nil {
+		meta, err := clientutil.NewMetaFromBlobStore(f.fs.bs, f.Ref)
+		if err != nil {
+			return nil, fuseError("Open", f, err)
+		}
+		f.Meta = meta
+	}
+	ffile, err := clientutil.NewFakeFile(f.fs.bs, f.Meta)
+	if err != nil {
+		return nil, fuseError("Open", f, err)
+	}
+	f.FakeFile = ffile
 	return f, nil
 }
 
@@ -392,8 +498,7 @@ func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, res *fuse.ReadRe
 		err = nil
 	}
 	if err != nil {
-		log.Printf("Error reading FakeFile %+v on %v at %d: %v", f, f.Ref, req.Offset, err)
-		return fuse.EIO
+		return fuseError("Read", f, err)
 	}
 	res.Data = buf[:n]
 	return nil
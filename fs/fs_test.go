@@ -46,7 +46,7 @@ func TestFS(t *testing.T) {
 
 	up, _ := snapshot.NewUploader("")
 	defer up.Close()
-	meta, err := up.Put(tdir)
+	_, meta, err := up.Put(tdir, nil)
 	check(err)
 
 	t.Logf("Upload done")
@@ -0,0 +1,38 @@
+package fssnap
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Btrfs creates read-only btrfs subvolume snapshots, the path must be a subvolume.
+//
+// The snapshot is created in a hidden directory next to the subvolume
+// (so the parent directory must be on the same btrfs filesystem).
+type Btrfs struct{}
+
+func (b *Btrfs) Snapshot(path string) (*Snapshot, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(filepath.Dir(path), ".blobsnap-"+newID())
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return nil, err
+	}
+	snapPath := filepath.Join(dir, filepath.Base(path))
+	if _, err := run("btrfs", "subvolume", "snapshot", "-r", path, snapPath); err != nil {
+		os.Remove(dir)
+		return nil, err
+	}
+	return &Snapshot{
+		Orig: path,
+		Path: snapPath,
+		remove: func() error {
+			if _, err := run("btrfs", "subvolume", "delete", snapPath); err != nil {
+				return err
+			}
+			return os.Remove(dir)
+		},
+	}, nil
+}
@@ -0,0 +1,92 @@
+package fssnap
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Copy "snapshots" the path by copying it to a temporary directory,
+// it works on any filesystem (but it's not atomic) and is mostly useful for testing.
+type Copy struct {
+	// Dir is the directory where the copies are created (os.TempDir() if empty)
+	Dir string
+}
+
+func (c *Copy) Snapshot(path string) (*Snapshot, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(c.Dir, "blobsnap-copy-")
+	if err != nil {
+		return nil, err
+	}
+	snapPath := filepath.Join(dir, filepath.Base(path))
+	if err := copyPath(path, snapPath); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &Snapshot{
+		Orig: path,
+		Path: snapPath,
+		remove: func() error {
+			return os.RemoveAll(dir)
+		},
+	}, nil
+}
+
+// copyPath recursively copies src to dst, keeping the mode and the modification times.
+func copyPath(src, dst string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	case fi.IsDir():
+		if err := os.Mkdir(dst, 0700); err != nil {
+			return err
+		}
+		fis, err := ioutil.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, cfi := range fis {
+			if err := copyPath(filepath.Join(src, cfi.Name()), filepath.Join(dst, cfi.Name())); err != nil {
+				return err
+			}
+		}
+	default:
+		if err := copyFile(src, dst); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(dst, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,117 @@
+/*
+Package fssnap creates point-in-time filesystem snapshots (btrfs, LVM...), so a whole
+tree can be backed up in a consistent state while it's still being modified.
+
+A snapshot is created from the live path, the backup is made from the snapshot path,
+and the snapshot is removed afterwards:
+
+	snap, err := fssnap.Create("btrfs", "/data")
+	if err != nil {
+		return err
+	}
+	defer snap.Remove()
+	// backup snap.Path
+
+The snapshot path always has the same base name as the live path.
+*/
+package fssnap
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tsileo/blobsnap/clientutil"
+)
+
+// Provider creates filesystem snapshots.
+type Provider interface {
+	// Snapshot creates a read-only snapshot of path
+	Snapshot(path string) (*Snapshot, error)
+}
+
+// Snapshot is a point-in-time copy of a path.
+type Snapshot struct {
+	// Path of the original file/directory
+	Orig string
+
+	// Path of the snapshotted file/directory
+	Path string
+
+	remove func() error
+}
+
+// Remove removes the snapshot.
+func (s *Snapshot) Remove() error {
+	if s.remove == nil {
+		return nil
+	}
+	return s.remove()
+}
+
+var (
+	providersMu sync.Mutex
+	providers   = map[string]Provider{}
+)
+
+// Register makes a provider available by the given name.
+func Register(name string, provider Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[name] = provider
+}
+
+// Get returns the provider registered with the given name.
+func Get(name string) (Provider, error) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	provider, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown filesystem snapshot provider %q, must be one of %v", name, providerNames())
+	}
+	return provider, nil
+}
+
+func providerNames() []string {
+	names := []string{}
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Create creates a snapshot of path with the given provider.
+func Create(name, path string) (*Snapshot, error) {
+	provider, err := Get(name)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := provider.Snapshot(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %v snapshot of %v: %v", name, path, err)
+	}
+	return snap, nil
+}
+
+func init() {
+	Register("btrfs", &Btrfs{})
+	Register("lvm", &LVM{})
+	Register("copy", &Copy{})
+}
+
+// newID returns a short random ID used to name the snapshots.
+func newID() string {
+	return clientutil.NewID()[:12]
+}
+
+// run executes the command, the output is included in the error.
+func run(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v %v failed: %v (%v)", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,68 @@
+package fssnap
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopy(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "blobsnap-fssnap-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+	path := filepath.Join(tdir, "data")
+	if err := os.MkdirAll(filepath.Join(path, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, "sub", "file"), []byte("content"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := Create("copy", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Orig != path {
+		t.Errorf("bad orig path %v, expected %v", snap.Orig, path)
+	}
+	if filepath.Base(snap.Path) != "data" {
+		t.Errorf("snapshot path %v should keep the base name", snap.Path)
+	}
+	// The snapshot must not change when the original is modified
+	if err := ioutil.WriteFile(filepath.Join(path, "sub", "file"), []byte("modified"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(snap.Path, "sub", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "content" {
+		t.Errorf("bad snapshot content %q", data)
+	}
+	fi, err := os.Stat(filepath.Join(snap.Path, "sub", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("bad mode %v", fi.Mode())
+	}
+	if err := snap.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(snap.Path); !os.IsNotExist(err) {
+		t.Errorf("snapshot %v should be removed", snap.Path)
+	}
+}
+
+func TestGet(t *testing.T) {
+	for _, name := range []string{"btrfs", "lvm", "copy"} {
+		if _, err := Get(name); err != nil {
+			t.Errorf("provider %v should be registered: %v", name, err)
+		}
+	}
+	if _, err := Get("zfs"); err == nil {
+		t.Errorf("unknown provider should fail")
+	}
+}
@@ -0,0 +1,92 @@
+package fssnap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LVM creates a snapshot of the logical volume containing the path, and mounts it read-only.
+type LVM struct {
+	// Size of the snapshot (lvcreate --extents), 10%ORIGIN if empty
+	Extents string
+}
+
+func (l *LVM) Snapshot(path string) (*Snapshot, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	// Find the volume and the mount point containing the path
+	out, err := run("findmnt", "--noheadings", "--output", "SOURCE,TARGET,FSTYPE", "--target", path)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("unexpected findmnt output %q", out)
+	}
+	device, mountpoint, fstype := fields[0], fields[1], fields[2]
+	rel, err := filepath.Rel(mountpoint, path)
+	if err != nil {
+		return nil, err
+	}
+	extents := l.Extents
+	if extents == "" {
+		extents = "10%ORIGIN"
+	}
+	// The snapshot is created in the same volume group as the origin
+	vg, err := run("lvs", "--noheadings", "--options", "vg_name", device)
+	if err != nil {
+		return nil, err
+	}
+	name := "blobsnap-" + newID()
+	if _, err := run("lvcreate", "--snapshot", "--extents", extents, "--name", name, device); err != nil {
+		return nil, err
+	}
+	snapDevice := filepath.Join("/dev", vg, name)
+	removeLV := func() error {
+		_, err := run("lvremove", "--force", snapDevice)
+		return err
+	}
+	dir, err := ioutil.TempDir("", "blobsnap-lvm-")
+	if err != nil {
+		removeLV()
+		return nil, err
+	}
+	// Keep the base name of the path if it's the mount point
+	mnt := filepath.Join(dir, "mnt")
+	if rel == "." {
+		mnt = filepath.Join(dir, filepath.Base(path))
+	}
+	if err := os.Mkdir(mnt, 0700); err != nil {
+		os.RemoveAll(dir)
+		removeLV()
+		return nil, err
+	}
+	opts := "ro"
+	if fstype == "xfs" {
+		// The snapshot has the same UUID as the origin
+		opts += ",nouuid"
+	}
+	if _, err := run("mount", "-o", opts, snapDevice, mnt); err != nil {
+		os.RemoveAll(dir)
+		removeLV()
+		return nil, err
+	}
+	return &Snapshot{
+		Orig: path,
+		Path: filepath.Join(mnt, rel),
+		remove: func() error {
+			if _, err := run("umount", mnt); err != nil {
+				return err
+			}
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+			return removeLV()
+		},
+	}, nil
+}
@@ -2,48 +2,63 @@ package scheduler
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
-	"sync"
+	"path/filepath"
 	"time"
-)
 
-var (
-	config        *Config
-	configLock    = new(sync.RWMutex)
-	configUpdated = make(chan struct{})
+	"github.com/robfig/cron"
+
+	"github.com/tsileo/blobsnap/clientutil"
+	"github.com/tsileo/blobsnap/fssnap"
+	"github.com/tsileo/blobsnap/snapshot"
 )
 
-func loadConfig(fail bool) {
-	file, err := ioutil.ReadFile("config.json")
-	if err != nil {
-		log.Println("open config: ", err)
-		if fail {
-			os.Exit(1)
-		}
+// ConfigPath returns the path of the config file, path if not empty,
+// or the BLOBSNAP_SCHEDULER_CONFIG environment variable,
+// or $XDG_CONFIG_HOME/blobsnap/scheduler.json (defaults to ~/.config/blobsnap/scheduler.json).
+func ConfigPath(path string) string {
+	if path != "" {
+		return path
+	}
+	if path := os.Getenv("BLOBSNAP_SCHEDULER_CONFIG"); path != "" {
+		return path
 	}
+	return filepath.Join(xdgDir("XDG_CONFIG_HOME", ".config"), "blobsnap", "scheduler.json")
+}
 
-	temp := new(Config)
-	if err = json.Unmarshal(file, temp); err != nil {
-		log.Println("parse config: ", err)
-		if fail {
-			os.Exit(1)
-		}
+// xdgDir returns the XDG base directory from the env, or its default location in the home directory.
+func xdgDir(env, fallback string) string {
+	if dir := os.Getenv(env); dir != "" {
+		return dir
 	}
-	configLock.Lock()
-	config = temp
-	configLock.Unlock()
+	return filepath.Join(os.Getenv("HOME"), fallback)
 }
 
-func GetConfig() *Config {
-	configLock.RLock()
-	defer configLock.RUnlock()
-	return config
+// LoadConfig reads and validates the config file.
+func LoadConfig(path string) (*Config, error) {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config: %v", err)
+	}
+	conf := &Config{}
+	if err := json.Unmarshal(file, conf); err != nil {
+		return nil, fmt.Errorf("failed to parse config %v: %v", path, err)
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %v: %v", path, err)
+	}
+	return conf, nil
 }
 
-func watchFile(filePath string) error {
+// errWatchStopped is returned by watchFile when the watch is stopped.
+var errWatchStopped = errors.New("watch stopped")
+
+// watchFile blocks until the file is modified (or stop is closed).
+func watchFile(filePath string, stop <-chan struct{}) error {
 	initialStat, err := os.Stat(filePath)
 	if err != nil {
 		return err
@@ -59,32 +74,243 @@ func watchFile(filePath string) error {
 			break
 		}
 
-		time.Sleep(1 * time.Second)
+		select {
+		case <-time.After(1 * time.Second):
+		case <-stop:
+			return errWatchStopped
+		}
 	}
 
 	return nil
 }
 
-func init() {
-	loadConfig(true)
-	go func() {
-		for {
-			err := watchFile("config.json")
-			if err != nil {
-				fmt.Println(err)
+// watchConfig reloads the config each time the file is modified, and sends it
+// to updated until stop is closed. A broken config is logged and ignored.
+func watchConfig(path string, updated chan<- *Config, stop <-chan struct{}) {
+	for {
+		err := watchFile(path, stop)
+		if err == errWatchStopped {
+			return
+		}
+		if err != nil {
+			log.Printf("failed to watch config: %v", err)
+			select {
+			case <-time.After(5 * time.Second):
+			case <-stop:
+				return
 			}
-			loadConfig(false)
-			configUpdated <- struct{}{}
+			continue
+		}
+		conf, err := LoadConfig(path)
+		if err != nil {
+			log.Printf("%v, keeping the previous config", err)
+			continue
 		}
-	}()
+		select {
+		case updated <- conf:
+		case <-stop:
+			return
+		}
+	}
 }
 
 type ConfigEntry struct {
 	Path string `json:"path"`
-	Spec string `json:"spec"`
+
+	// Paths snapshot several paths as a single snapshot (named Name), instead of Path
+	Paths []string `json:"paths,omitempty"`
+
+	Spec    string            `json:"spec"`
+	Comment string            `json:"comment,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+
+	// Exec/Name snapshot the output of a command (instead of Path) as a file named Name
+	Exec string `json:"exec,omitempty"`
+	Name string `json:"name,omitempty"`
+
+	Hooks *snapshot.Hooks `json:"hooks,omitempty"`
+
+	// Retries is the number of retries after a failure, the delay
+	// before the first retry is RetryDelay (1m by default), doubled after each retry
+	Retries    int    `json:"retries,omitempty"`
+	RetryDelay string `json:"retry_delay,omitempty"`
+
+	// Overlap defines what happens if the job is still running when it's scheduled again:
+	// "skip" (the default) the new run, "queue" it until the previous one is done,
+	// or "cancel" the previous run
+	Overlap string `json:"overlap,omitempty"`
+
+	// Timeout cancels an attempt if it takes longer (no timeout if empty)
+	Timeout string `json:"timeout,omitempty"`
+
+	// FSSnapshot is the filesystem snapshot provider (btrfs, lvm or copy)
+	// used to backup a point-in-time snapshot of Path
+	FSSnapshot string `json:"fs_snapshot,omitempty"`
+
+	// Excludes defines the files/directories left out of the snapshot (in addition to the ignore files)
+	Excludes *clientutil.Excludes `json:"excludes,omitempty"`
+
+	// RecordExcluded stores the excluded paths in the snapshots
+	RecordExcluded bool `json:"record_excluded,omitempty"`
+
+	// Sparse stores the regions of zeros of the files as holes
+	Sparse bool `json:"sparse,omitempty"`
+}
+
+// timeout returns the maximum duration of an attempt (0 if there's no timeout).
+func (e *ConfigEntry) timeout() (time.Duration, error) {
+	if e.Timeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(e.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q: %v", e.Timeout, err)
+	}
+	return timeout, nil
+}
+
+// retryDelay returns the delay before the first retry.
+func (e *ConfigEntry) retryDelay() (time.Duration, error) {
+	if e.RetryDelay == "" {
+		return time.Minute, nil
+	}
+	delay, err := time.ParseDuration(e.RetryDelay)
+	if err != nil {
+		return 0, fmt.Errorf("invalid retry delay %q: %v", e.RetryDelay, err)
+	}
+	return delay, nil
+}
+
+// SnapshotPath returns the path of the snapshot (the virtual path for an exec entry).
+func (e *ConfigEntry) SnapshotPath() string {
+	if e.Exec != "" {
+		return snapshot.StdinPath(e.Name)
+	}
+	if len(e.Paths) > 0 {
+		name := e.Name
+		if name == "" {
+			name = snapshot.MultiName(e.Paths)
+		}
+		return snapshot.MultiPath(name)
+	}
+	return e.Path
+}
+
+// Key returns a unique key for the entry.
+func (e *ConfigEntry) Key() string {
+	return fmt.Sprintf("%v-%v", e.SnapshotPath(), e.Spec)
+}
+
+// Validate checks the spec, and the path (or the exec command) of the entry.
+func (e *ConfigEntry) Validate() error {
+	if _, err := cron.Parse(e.Spec); err != nil {
+		return fmt.Errorf("bad spec %q: %v", e.Spec, err)
+	}
+	switch {
+	case e.Exec != "":
+		if e.Path != "" || len(e.Paths) > 0 {
+			return fmt.Errorf("path/paths and exec are mutually exclusive")
+		}
+		if e.Name == "" {
+			return fmt.Errorf("exec %q requires a name", e.Exec)
+		}
+	case len(e.Paths) > 0:
+		if e.Path != "" {
+			return fmt.Errorf("path and paths are mutually exclusive")
+		}
+		for _, path := range e.Paths {
+			if !filepath.IsAbs(path) {
+				return fmt.Errorf("path %q must be absolute", path)
+			}
+		}
+		if err := snapshot.CheckPaths(e.Paths); err != nil {
+			return err
+		}
+	case e.Path == "":
+		return fmt.Errorf("missing path")
+	case !filepath.IsAbs(e.Path):
+		return fmt.Errorf("path %q must be absolute", e.Path)
+	default:
+		if _, err := os.Stat(e.Path); err != nil {
+			// The path may not be available yet (e.g. an external drive)
+			log.Printf("warning: %v", err)
+		}
+	}
+	if e.Hooks != nil {
+		if err := e.Hooks.Validate(); err != nil {
+			return err
+		}
+	}
+	if e.Excludes != nil && e.Exec != "" {
+		return fmt.Errorf("excludes can't be used with exec")
+	}
+	if e.FSSnapshot != "" {
+		if e.Exec != "" {
+			return fmt.Errorf("fs_snapshot can't be used with exec")
+		}
+		if _, err := fssnap.Get(e.FSSnapshot); err != nil {
+			return err
+		}
+	}
+	if e.Retries < 0 {
+		return fmt.Errorf("retries must be positive")
+	}
+	switch e.Overlap {
+	case "", "skip", "queue", "cancel":
+	default:
+		return fmt.Errorf("invalid overlap policy %q, must be \"skip\", \"queue\" or \"cancel\"", e.Overlap)
+	}
+	if _, err := e.timeout(); err != nil {
+		return err
+	}
+	if _, err := e.retryDelay(); err != nil {
+		return err
+	}
+	return nil
 }
 
 type Config struct {
 	AnacronMode bool          `json:"anacron_mode"`
 	Snapshots   []ConfigEntry `json:"snapshots"`
+
+	// MaxConcurrentJobs limits the number of jobs running at the same time (0 means no limit)
+	MaxConcurrentJobs int `json:"max_concurrent_jobs,omitempty"`
+
+	// ShutdownTimeout is the time to wait for running jobs on shutdown
+	// before canceling them (1m by default)
+	ShutdownTimeout string `json:"shutdown_timeout,omitempty"`
+}
+
+// shutdownTimeout returns the time to wait for running jobs on shutdown.
+func (c *Config) shutdownTimeout() (time.Duration, error) {
+	if c.ShutdownTimeout == "" {
+		return time.Minute, nil
+	}
+	timeout, err := time.ParseDuration(c.ShutdownTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid shutdown timeout %q: %v", c.ShutdownTimeout, err)
+	}
+	return timeout, nil
+}
+
+// Validate checks every entries.
+func (c *Config) Validate() error {
+	if c.MaxConcurrentJobs < 0 {
+		return fmt.Errorf("max_concurrent_jobs must be positive")
+	}
+	if _, err := c.shutdownTimeout(); err != nil {
+		return err
+	}
+	keys := map[string]bool{}
+	for i, entry := range c.Snapshots {
+		if err := entry.Validate(); err != nil {
+			return fmt.Errorf("snapshot #%d: %v", i, err)
+		}
+		key := entry.Key()
+		if keys[key] {
+			return fmt.Errorf("snapshot #%d: duplicate entry for %v (%v)", i, entry.SnapshotPath(), entry.Spec)
+		}
+		keys[key] = true
+	}
+	return nil
 }
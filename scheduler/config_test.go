@@ -0,0 +1,122 @@
+package scheduler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tsileo/blobsnap/snapshot"
+)
+
+func TestConfigPath(t *testing.T) {
+	os.Setenv("BLOBSNAP_SCHEDULER_CONFIG", "")
+	os.Setenv("XDG_CONFIG_HOME", "/tmp/xdg")
+	if p := ConfigPath(""); p != "/tmp/xdg/blobsnap/scheduler.json" {
+		t.Errorf("bad default config path: %v", p)
+	}
+	os.Setenv("BLOBSNAP_SCHEDULER_CONFIG", "/etc/blobsnap.json")
+	if p := ConfigPath(""); p != "/etc/blobsnap.json" {
+		t.Errorf("config path should be read from the env: %v", p)
+	}
+	if p := ConfigPath("config.json"); p != "config.json" {
+		t.Errorf("config path should be the given path: %v", p)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	bad := []ConfigEntry{
+		{Path: "/tmp", Spec: "every day"},
+		{Path: "", Spec: "@every 1h"},
+		{Path: "relative/path", Spec: "@every 1h"},
+		{Path: "/tmp", Exec: "pg_dump", Name: "db.sql", Spec: "@every 1h"},
+		{Exec: "pg_dump", Spec: "@every 1h"},
+		{Path: "/tmp", Spec: "@every 1h", Hooks: &snapshot.Hooks{Timeout: "forever"}},
+		{Path: "/tmp", Spec: "@every 1h", Retries: -1},
+		{Path: "/tmp", Spec: "@every 1h", Overlap: "parallel"},
+		{Path: "/tmp", Spec: "@every 1h", Timeout: "1 hour"},
+		{Path: "/tmp", Spec: "@every 1h", FSSnapshot: "zfs"},
+		{Paths: []string{"/etc", "var"}, Spec: "@every 1h"},
+		{Paths: []string{"/var", "/var/lib"}, Spec: "@every 1h"},
+		{Path: "/etc", Paths: []string{"/var"}, Spec: "@every 1h"},
+		{Exec: "pg_dump", Name: "db.sql", Spec: "@every 1h", FSSnapshot: "copy"},
+		{Path: "/tmp", Spec: "@every 1h", Retries: 3, RetryDelay: "soon"},
+	}
+	for _, entry := range bad {
+		conf := &Config{Snapshots: []ConfigEntry{entry}}
+		if err := conf.Validate(); err == nil {
+			t.Errorf("entry %+v should be invalid", entry)
+		}
+	}
+	conf := &Config{Snapshots: []ConfigEntry{
+		{Path: "/tmp", Spec: "@every 1h", Retries: 3, RetryDelay: "30s"},
+		{Exec: "pg_dump", Name: "db.sql", Spec: "0 30 * * * *", Overlap: "queue"},
+		{Paths: []string{"/var/lib/app", "/etc"}, Spec: "@every 1h"},
+	}}
+	if err := conf.Validate(); err != nil {
+		t.Errorf("config should be valid: %v", err)
+	}
+	if p := conf.Snapshots[2].SnapshotPath(); p != snapshot.MultiPath(snapshot.MultiName([]string{"/etc", "/var/lib/app"})) || !strings.HasPrefix(p, "multi:app+etc-") {
+		t.Errorf("bad multi-paths snapshot path %v", p)
+	}
+	conf.ShutdownTimeout = "5 minutes"
+	if err := conf.Validate(); err == nil {
+		t.Errorf("bad shutdown timeout should be invalid")
+	}
+	conf.ShutdownTimeout = "5m"
+	conf.Snapshots = append(conf.Snapshots, ConfigEntry{Path: "/tmp", Spec: "@every 1h"})
+	if err := conf.Validate(); err == nil {
+		t.Errorf("duplicate entries should be invalid")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "blobsnap-scheduler-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "config.json")
+	if _, err := LoadConfig(path); err == nil {
+		t.Errorf("missing config should fail")
+	}
+	ioutil.WriteFile(path, []byte(`{"snapshots": [{"path": "/tmp", "spec": "@every 1h"}`), 0644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Errorf("malformed config should fail")
+	}
+	ioutil.WriteFile(path, []byte(`{"anacron_mode": true, "snapshots": [{"path": "/tmp", "spec": "@every 1h"}]}`), 0644)
+	conf, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if !conf.AnacronMode || len(conf.Snapshots) != 1 || conf.Snapshots[0].Path != "/tmp" {
+		t.Errorf("bad config: %+v", conf)
+	}
+}
+
+func TestWatchConfigStop(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "blobsnap-scheduler-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "config.json")
+	ioutil.WriteFile(path, []byte(`{"snapshots": []}`), 0644)
+	// Nobody reads the updates, the watcher must still return once stopped
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		watchConfig(path, make(chan *Config), stop)
+		close(done)
+	}()
+	ioutil.WriteFile(path, []byte(`{"snapshots": [{"path": "/tmp", "spec": "@every 1h"}]}`), 0644)
+	time.Sleep(1500 * time.Millisecond)
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("the watcher should be stopped")
+	}
+}
@@ -0,0 +1,261 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cznic/kv"
+)
+
+// DBPath returns the path of the state database, path if not empty,
+// or the BLOBSNAP_SCHEDULER_DB environment variable,
+// or $XDG_DATA_HOME/blobsnap/scheduler-db (defaults to ~/.local/share/blobsnap/scheduler-db).
+func DBPath(path string) string {
+	if path != "" {
+		return path
+	}
+	if path := os.Getenv("BLOBSNAP_SCHEDULER_DB"); path != "" {
+		return path
+	}
+	return filepath.Join(xdgDir("XDG_DATA_HOME", filepath.Join(".local", "share")), "blobsnap", "scheduler-db")
+}
+
+func opts() *kv.Options {
+	return &kv.Options{
+		VerifyDbBeforeOpen:  true,
+		VerifyDbAfterOpen:   true,
+		VerifyDbBeforeClose: true,
+		VerifyDbAfterClose:  true,
+	}
+}
+
+// New initialize a new KV database.
+func NewDB(path string) (*kv.DB, error) {
+	createOpen := kv.Open
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		createOpen = kv.Create
+	}
+	return createOpen(path, opts())
+}
+
+// stateDB stores the jobs state, the kv database is only opened during each operation
+// so it can be inspected (see Status) while the scheduler is running.
+type stateDB struct {
+	path string
+	sync.Mutex
+}
+
+func newStateDB(path string) (*stateDB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create the db directory: %v", err)
+	}
+	s := &stateDB{path: path}
+	// Check that the database can be created/opened
+	if err := s.do(func(db *kv.DB) error { return nil }); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// do opens the database and calls fn, opening is retried for a few seconds
+// if the database is being used by another process.
+func (s *stateDB) do(fn func(db *kv.DB) error) error {
+	s.Lock()
+	defer s.Unlock()
+	var db *kv.DB
+	var err error
+	for i := 0; i < 20; i++ {
+		db, err = NewDB(s.path)
+		if err == nil {
+			break
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open db %v: %v", s.path, err)
+	}
+	defer db.Close()
+	return fn(db)
+}
+
+// Get returns the value stored for the key, or an empty string.
+func (s *stateDB) Get(key string) (string, error) {
+	var res []byte
+	err := s.do(func(db *kv.DB) (err error) {
+		res, err = db.Get(nil, []byte(key))
+		return
+	})
+	return string(res), err
+}
+
+// Set stores the value for the key.
+func (s *stateDB) Set(key, value string) error {
+	return s.do(func(db *kv.DB) error {
+		return db.Set([]byte(key), []byte(value))
+	})
+}
+
+// historySize is the number of results kept in each job history.
+var historySize = 100
+
+const historyPrefix = "history:"
+
+// historyKey returns the DB key of the job result, results are sorted by start time.
+func historyKey(res *JobResult) string {
+	return fmt.Sprintf("%v%v:%020d", historyPrefix, res.Key, res.Start.UnixNano())
+}
+
+// AddHistory stores the job result, and removes the oldest results to keep
+// the last size results of the job.
+func (s *stateDB) AddHistory(res *JobResult, size int) error {
+	js, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return s.do(func(db *kv.DB) error {
+		if err := db.Set([]byte(historyKey(res)), js); err != nil {
+			return err
+		}
+		keys, _, err := scanHistory(db, fmt.Sprintf("%v%v:", historyPrefix, res.Key))
+		if err != nil {
+			return err
+		}
+		for len(keys) > size {
+			if err := db.Delete([]byte(keys[0])); err != nil {
+				return err
+			}
+			keys = keys[1:]
+		}
+		return nil
+	})
+}
+
+// scanHistory returns the keys/results starting with the given prefix (oldest first).
+func scanHistory(db *kv.DB, prefix string) ([]string, []*JobResult, error) {
+	keys := []string{}
+	results := []*JobResult{}
+	enum, _, err := db.Seek([]byte(prefix))
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		k, v, err := enum.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if !strings.HasPrefix(string(k), prefix) {
+			break
+		}
+		res := &JobResult{}
+		if err := json.Unmarshal(v, res); err != nil {
+			return nil, nil, fmt.Errorf("failed to unmarshal %s: %v", k, err)
+		}
+		keys = append(keys, string(k))
+		results = append(results, res)
+	}
+	return keys, results, nil
+}
+
+// History returns the last results of the job with the given key (of every jobs if key is empty),
+// oldest first (dbPath is resolved with DBPath).
+func History(dbPath, key string) ([]*JobResult, error) {
+	dbPath = DBPath(dbPath)
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, fmt.Errorf("no scheduler db: %v", err)
+	}
+	s := &stateDB{path: dbPath}
+	prefix := historyPrefix
+	if key != "" {
+		prefix = fmt.Sprintf("%v%v:", historyPrefix, key)
+	}
+	var results []*JobResult
+	err := s.do(func(db *kv.DB) (err error) {
+		_, results, err = scanHistory(db, prefix)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		sort.Sort(byStart(results))
+	}
+	return results, nil
+}
+
+type byStart []*JobResult
+
+func (s byStart) Len() int           { return len(s) }
+func (s byStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byStart) Less(i, j int) bool { return s[i].Start.Before(s[j].Start) }
+
+// JobStatus is the state of a Job, as stored in the DB.
+type JobStatus struct {
+	Key        string     `json:"key"`
+	Spec       string     `json:"spec"`
+	Prev       time.Time  `json:"prev"`
+	Next       time.Time  `json:"next"`
+	LastResult *JobResult `json:"last_result"`
+}
+
+// Status returns the state of every jobs stored in the DB (dbPath is resolved with DBPath).
+func Status(dbPath string) ([]*JobStatus, error) {
+	dbPath = DBPath(dbPath)
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, fmt.Errorf("no scheduler db: %v", err)
+	}
+	s := &stateDB{path: dbPath}
+	jobs := []*JobStatus{}
+	err := s.do(func(db *kv.DB) error {
+		enum, err := db.SeekFirst()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for {
+			k, v, err := enum.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(string(k), historyPrefix) {
+				continue
+			}
+			state, err := scanState(string(v))
+			if err != nil {
+				return fmt.Errorf("failed to scan job %s: %v", k, err)
+			}
+			jobs = append(jobs, &JobStatus{
+				Key:        string(k),
+				Spec:       state.Spec,
+				Prev:       state.Prev,
+				Next:       state.Next,
+				LastResult: state.LastResult,
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(byNext(jobs))
+	return jobs, nil
+}
+
+type byNext []*JobStatus
+
+func (s byNext) Len() int           { return len(s) }
+func (s byNext) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byNext) Less(i, j int) bool { return s[i].Next.Before(s[j].Next) }
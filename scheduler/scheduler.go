@@ -1,11 +1,21 @@
 /*
-
 Package scheduler implements a cron using robfig/cron parser [1]
 designed to perform snapshots.
 
-Configuration is "hot reloaded" so the scheduler doesn't need to be restarted to load the new config.
+Configuration is "hot reloaded" so the scheduler doesn't need to be restarted to load the new config,
+an invalid config is rejected and the previous one is kept.
+
+It stores the last/next run time and the last result of each job in a kv database [2],
+along with the history of the last runs, which can be inspected with Status and History.
+
+Failed jobs can be retried with an exponential backoff, the last run time is only updated on success.
+
+A job is never run twice at the same time, if a job is still running when it's scheduled again,
+the new run is either skipped, queued, or the previous run is canceled (see ConfigEntry.Overlap).
+The number of jobs running at the same time can be limited with Config.MaxConcurrentJobs.
 
-It stores the last run time in a kv database [2].
+On SIGINT/SIGTERM, no new jobs are started and the scheduler waits for the running jobs to finish,
+they're canceled if the shutdown timeout is exceeded (or on a second signal).
 
 The scheduler support an "anacron mode" [3] (intended for laptop users)
 where a job will be run if the delay has been exceeded (for simple recurring cycle
@@ -17,40 +27,46 @@ Links
 	[1]: https://github.com/robfig/cron
 	[2]: https://github.com/cznic/kv
 	[3]: http://anacron.sourceforge.net/
-
 */
 package scheduler
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/cznic/kv"
 	"github.com/robfig/cron"
+	"golang.org/x/net/context"
 
+	"github.com/tsileo/blobsnap/clientutil"
 	"github.com/tsileo/blobsnap/snapshot"
 )
 
 type Job struct {
-	uploader *snapshot.Uploader
+	uploader        *snapshot.Uploader
 	schedulerConfig *Config
-	config       *ConfigEntry
-	sched        cron.Schedule
-	Prev         time.Time
-	Next         time.Time
+	config          *ConfigEntry
+	sched           cron.Schedule
+	Prev            time.Time
+	Next            time.Time
+	LastResult      *JobResult
+
+	// Time of the last run started by the scheduler loop (Prev is only updated on success)
+	started time.Time
 }
 
 // NewJob initialize a Job
 func NewJob(conf *ConfigEntry, sched cron.Schedule) *Job {
 	return &Job{
 		config: conf,
-		sched: sched,
+		sched:  sched,
 	}
 }
 
@@ -58,7 +74,9 @@ func NewJob(conf *ConfigEntry, sched cron.Schedule) *Job {
 func (job *Job) ComputeNext(now time.Time) {
 	nowUTC := time.Now().UTC()
 	elapsed := nowUTC.Sub(job.Next)
-	if GetConfig().AnacronMode {
+	// A run has already been started for the current Next, it's not a missed run to catch up
+	caughtUp := !job.started.IsZero() && !job.started.Before(job.Next)
+	if job.schedulerConfig.AnacronMode && !caughtUp {
 		csd, ok := job.sched.(cron.ConstantDelaySchedule)
 		if !ok {
 			// If a job.Next exists check that it isn't over,
@@ -90,49 +108,174 @@ func (job *Job) ComputeNext(now time.Time) {
 
 // Key generate a unique Key for the Job (used as an ID in the DB).
 func (j *Job) Key() string {
-	return fmt.Sprintf("%v-%v", j.config.Path, j.config.Spec)
+	return j.config.Key()
 }
 
-func (j *Job) Run() error {
+// JobResult holds the outcome of a Job run (stored in the job history).
+type JobResult struct {
+	Key      string             `json:"key"`
+	Path     string             `json:"path"`
+	Spec     string             `json:"spec"`
+	Start    time.Time          `json:"start"`
+	End      time.Time          `json:"end"`
+	Duration time.Duration      `json:"duration"`
+	Attempts int                `json:"attempts"`
+	Ref      string             `json:"ref,omitempty"`
+	Snapshot *snapshot.Snapshot `json:"snapshot"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// Run performs the snapshot, failed attempts are retried (see ConfigEntry.Retries)
+// with an exponential backoff, until the context is canceled.
+func (j *Job) Run(ctx context.Context) *JobResult {
+	start := time.Now().UTC()
+	delay, err := j.config.retryDelay()
+	if err != nil {
+		return j.errorResult(err)
+	}
+	var res *JobResult
+	for attempt := 1; ; attempt++ {
+		res = j.run(ctx)
+		res.Attempts = attempt
+		if res.Error == "" || attempt > j.config.Retries {
+			break
+		}
+		log.Printf("Job %v failed (attempt %d/%d), retrying in %v", j, attempt, j.config.Retries+1, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			log.Printf("Job %v canceled, giving up", j)
+			res.Error = fmt.Sprintf("%v (%v)", res.Error, ctx.Err())
+			res.Start = start
+			res.Duration = res.End.Sub(res.Start)
+			return res
+		}
+		delay *= 2
+	}
+	res.Start = start
+	res.Duration = res.End.Sub(res.Start)
+	return res
+}
+
+// errorResult returns the result of a run that failed before starting the snapshot.
+func (j *Job) errorResult(err error) *JobResult {
+	now := time.Now().UTC()
+	return &JobResult{
+		Key:   j.Key(),
+		Path:  j.config.SnapshotPath(),
+		Spec:  j.config.Spec,
+		Start: now,
+		End:   now,
+		Error: err.Error(),
+	}
+}
+
+// run performs a single snapshot attempt.
+func (j *Job) run(ctx context.Context) *JobResult {
 	log.Printf("Running job %+v", j)
-	meta, err := j.uploader.Put(j.config.Path)
+	timeout, err := j.config.timeout()
 	if err != nil {
-		log.Printf("Failed to perform snapshot %v: err", j, err)
+		return j.errorResult(err)
 	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	res := &JobResult{
+		Key:   j.Key(),
+		Path:  j.config.SnapshotPath(),
+		Spec:  j.config.Spec,
+		Start: time.Now().UTC(),
+	}
+	opts := &snapshot.PutOptions{
+		Comment: j.config.Comment,
+		Tags:    j.config.Tags,
+		Hooks:   j.config.Hooks,
+
+		FSSnapshot:     j.config.FSSnapshot,
+		Excludes:       j.config.Excludes,
+		RecordExcluded: j.config.RecordExcluded,
+		Sparse:         j.config.Sparse,
+	}
+	var snap *snapshot.Snapshot
+	var meta *clientutil.Meta
+	switch {
+	case j.config.Exec != "":
+		snap, meta, err = j.uploader.PutCommandContext(ctx, j.config.Name, j.config.Exec, opts)
+	case len(j.config.Paths) > 0:
+		snap, meta, err = j.uploader.PutPathsContext(ctx, j.config.Name, j.config.Paths, opts)
+	default:
+		snap, meta, err = j.uploader.PutContext(ctx, j.config.Path, opts)
+	}
+	res.End = time.Now().UTC()
+	if err != nil {
+		log.Printf("Failed to perform snapshot %v: %v", j, err)
+		res.Error = err.Error()
+		return res
+	}
+	res.Snapshot = snap
+	res.Ref = meta.Hash
 	log.Printf("Snapshot done, meta: %v", meta.Hash)
-	return nil
+	return res
 }
 
 func (j *Job) String() string {
 	return fmt.Sprintf("Job %v:%v/prev:%v/next:%v)",
-		j.config.Path, j.config.Spec, j.Prev, j.Next)
+		j.config.SnapshotPath(), j.config.Spec, j.Prev, j.Next)
+}
+
+// jobState is the Job state stored in the DB.
+type jobState struct {
+	Spec       string     `json:"spec"`
+	Prev       time.Time  `json:"prev"`
+	Next       time.Time  `json:"next"`
+	LastResult *JobResult `json:"last_result,omitempty"`
 }
 
-// Value serialize the job.Prev/job.Next to store as a string in the DB.
+// Value serialize the job state to store as a string in the DB.
 func (j *Job) Value() string {
-	prev := "0"
-	next := "0"
-	if !j.Prev.IsZero() {
-		prev = j.Prev.Format(time.RFC3339)
-	}
-	if !j.Next.IsZero() {
-		next = j.Next.Format(time.RFC3339)
+	js, err := json.Marshal(&jobState{
+		Spec:       j.config.Spec,
+		Prev:       j.Prev,
+		Next:       j.Next,
+		LastResult: j.LastResult,
+	})
+	if err != nil {
+		panic(err)
 	}
-	return fmt.Sprintf("%v %v", prev, next)
+	return string(js)
 }
 
 // Scan job parse the previously serialized value stored in the DB.
-func ScanJob(job *Job, s string) (err error) {
+func ScanJob(job *Job, s string) error {
+	state, err := scanState(s)
+	if err != nil {
+		return err
+	}
+	job.Prev = state.Prev
+	job.Next = state.Next
+	job.LastResult = state.LastResult
+	return nil
+}
+
+// scanState parse a serialized job state, older versions stored "prev next".
+func scanState(s string) (state *jobState, err error) {
+	state = &jobState{}
+	if strings.HasPrefix(s, "{") {
+		err = json.Unmarshal([]byte(s), state)
+		return
+	}
 	var prev, next string
 	fmt.Sscan(s, &prev, &next)
 	if prev != "0" {
-		job.Prev, err = time.Parse(time.RFC3339, prev)
+		state.Prev, err = time.Parse(time.RFC3339, prev)
 		if err != nil {
 			return
 		}
 	}
 	if next != "0" {
-		job.Next, err = time.Parse(time.RFC3339, next)
+		state.Next, err = time.Parse(time.RFC3339, next)
 		if err != nil {
 			return
 		}
@@ -140,30 +283,25 @@ func ScanJob(job *Job, s string) (err error) {
 	return
 }
 
-func opts() *kv.Options {
-	return &kv.Options{
-		VerifyDbBeforeOpen:  true,
-		VerifyDbAfterOpen:   true,
-		VerifyDbBeforeClose: true,
-		VerifyDbAfterClose:  true,
-	}
-}
+type Scheduler struct {
+	// OnResult, if set, is called after each Job run.
+	OnResult func(*JobResult)
 
-// New initialize a new KV database.
-func NewDB(path string) (*kv.DB, error) {
-	createOpen := kv.Open
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		createOpen = kv.Create
-	}
-	return createOpen(path, opts())
-}
+	uploader *snapshot.Uploader
+
+	// Runs in progress (by job key), and a semaphore to limit the number of concurrent runs
+	runs map[string]*jobRun
+	sem  chan struct{}
+	wg   sync.WaitGroup
+
+	config        *Config
+	configPath    string
+	configUpdated chan *Config
 
-type Scheduler struct {
-	uploader  *snapshot.Uploader
 	stop    chan struct{}
 	running bool
 	jobs    []*Job
-	db      *kv.DB
+	db      *stateDB
 	sync.Mutex
 }
 
@@ -184,41 +322,103 @@ func (s byTime) Less(i, j int) bool {
 	return s[i].Next.Before(s[j].Next)
 }
 
-func New(uploader *snapshot.Uploader) *Scheduler {
-	db, err := NewDB("scheduler-db")
+// New initializes a Scheduler, configPath and dbPath are resolved with ConfigPath and DBPath.
+func New(uploader *snapshot.Uploader, configPath, dbPath string) (*Scheduler, error) {
+	configPath = ConfigPath(configPath)
+	conf, err := LoadConfig(configPath)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return &Scheduler{
-		uploader: uploader,
-		stop: make(chan struct{}),
-		jobs: []*Job{},
-		db: db,
+	db, err := newStateDB(DBPath(dbPath))
+	if err != nil {
+		return nil, err
 	}
+	return &Scheduler{
+		uploader:      uploader,
+		runs:          map[string]*jobRun{},
+		sem:           newSem(conf.MaxConcurrentJobs),
+		config:        conf,
+		configPath:    configPath,
+		configUpdated: make(chan *Config),
+		stop:          make(chan struct{}),
+		jobs:          []*Job{},
+		db:            db,
+	}, nil
 }
 
-// Stop shutdown the Scheduler cleanly.
+// Stop shutdown the Scheduler cleanly (see Run).
 func (d *Scheduler) Stop() {
 	d.stop <- struct{}{}
 }
 
+// shutdown waits for the running jobs to finish, they're canceled if they're still
+// running after the shutdown timeout (or if another signal is received), and flushes the blobs.
+func (d *Scheduler) shutdown(cs <-chan os.Signal) {
+	d.Lock()
+	d.running = false
+	timeout, err := d.config.shutdownTimeout()
+	if err != nil {
+		log.Printf("%v, using the default", err)
+		timeout = time.Minute
+	}
+	log.Printf("Waiting for %d running job(s) to finish (timeout: %v)...", len(d.runs), timeout)
+	d.Unlock()
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Println("Shutdown timeout exceeded, canceling running jobs")
+		d.cancelRuns()
+		<-done
+	case sig := <-cs:
+		log.Printf("captured %v, canceling running jobs", sig)
+		d.cancelRuns()
+		<-done
+	}
+	log.Println("Waiting for the blobs to be uploaded...")
+	if err := d.uploader.Close(); err != nil {
+		log.Printf("failed to close uploader: %v", err)
+	}
+}
+
+// cancelRuns cancels every runs in progress.
+func (d *Scheduler) cancelRuns() {
+	d.Lock()
+	defer d.Unlock()
+	for _, run := range d.runs {
+		run.cancel()
+	}
+}
+
 // Run start the processing of jobs, and listen for config update.
-func (d *Scheduler) Run() {
-	log.Println("Running...")
-	defer d.db.Close()
+// It returns once the scheduler is stopped (by Stop or by a signal), after waiting
+// for the running jobs to finish (see Config.ShutdownTimeout) and closing the uploader.
+func (d *Scheduler) Run() error {
+	log.Printf("Running with config %v (db: %v)...", d.configPath, d.db.path)
+	if err := d.updateJobs(d.config); err != nil {
+		return err
+	}
+	// Stops the config watcher once the scheduler is stopped
+	quit := make(chan struct{})
+	defer close(quit)
+	go watchConfig(d.configPath, d.configUpdated, quit)
 	cs := make(chan os.Signal, 1)
 	signal.Notify(cs, os.Interrupt,
 		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
-	if err := d.updateJobs(); err != nil {
-		panic(err)
-	}
+	defer signal.Stop(cs)
 	now := time.Now().UTC()
 	d.running = true
 	var checkTime time.Time
 	for {
+		// The jobs are also read/updated by the runs in progress
+		d.Lock()
 		sort.Sort(byTime(d.jobs))
 		if len(d.jobs) == 0 {
 			// Sleep for 5 years until the config change
@@ -227,68 +427,186 @@ func (d *Scheduler) Run() {
 			log.Printf("sleep until %v", d.jobs[0].Next)
 			checkTime = d.jobs[0].Next
 		}
+		d.Unlock()
 		select {
 		case now = <-time.After(checkTime.Sub(now)):
+			d.Lock()
 			for _, job := range d.jobs {
 				if now.Sub(job.Next) < 0 {
 					break
 				}
-				d.Lock()
-				go job.Run()
-				job.Prev = job.Next
+				d.startJob(job, job.Next)
+				// job.Prev will only be updated if the snapshot succeed
+				job.started = now
 				job.ComputeNext(now)
-				if err := d.db.Set([]byte(job.Key()), []byte(job.Value())); err != nil {
-					panic(err)
+				if err := d.db.Set(job.Key(), job.Value()); err != nil {
+					log.Printf("failed to save job %v: %v", job, err)
 				}
-				d.Unlock()
-				continue
 			}
+			d.Unlock()
 		case <-d.stop:
-			d.running = false
-			return
-		case <-configUpdated:
+			d.shutdown(cs)
+			return nil
+		case conf := <-d.configUpdated:
 			log.Println("config updated")
-			d.updateJobs()
+			if err := d.updateJobs(conf); err != nil {
+				log.Printf("failed to update jobs, keeping the previous config: %v", err)
+			}
 		case sig := <-cs:
 			log.Printf("captured %v\n", sig)
-			d.db.Close()
-			os.Exit(1)
+			d.shutdown(cs)
+			return nil
 		}
 	}
 }
 
-// updateJobs parse the config and detect the next scheduled job.
-func (d *Scheduler) updateJobs() error {
+// jobRun tracks a run in progress.
+type jobRun struct {
+	cancel context.CancelFunc
+
+	// Set if another run must be started once this one is done
+	queued    bool
+	scheduled time.Time
+}
+
+// newSem returns a semaphore limiting the number of concurrent runs (nil if unlimited).
+func newSem(size int) chan struct{} {
+	if size <= 0 {
+		return nil
+	}
+	return make(chan struct{}, size)
+}
+
+// job returns the current Job with the given key (the config may have been reloaded).
+func (d *Scheduler) job(key string) *Job {
+	for _, job := range d.jobs {
+		if job.Key() == key {
+			return job
+		}
+	}
+	return nil
+}
+
+// startJob starts the Job scheduled at the given time, unless a previous run is still
+// in progress, in which case the job overlap policy is applied, d must be locked.
+func (d *Scheduler) startJob(job *Job, scheduled time.Time) {
+	key := job.Key()
+	if run, ok := d.runs[key]; ok {
+		switch job.config.Overlap {
+		case "queue":
+			log.Printf("Job %v still running, the next run is queued", job)
+			run.queued = true
+			run.scheduled = scheduled
+		case "cancel":
+			log.Printf("Job %v still running, canceling it", job)
+			run.cancel()
+			run.queued = true
+			run.scheduled = scheduled
+		default:
+			log.Printf("Job %v still running, skipping this run", job)
+		}
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.runs[key] = &jobRun{cancel: cancel}
+	d.wg.Add(1)
+	go d.runJob(ctx, job, scheduled, d.sem)
+}
+
+// runJob runs the Job scheduled at the given time, and reports the result.
+func (d *Scheduler) runJob(ctx context.Context, job *Job, scheduled time.Time, sem chan struct{}) {
+	defer d.wg.Done()
+	var res *JobResult
+	if sem != nil {
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+		case <-ctx.Done():
+		}
+	}
+	if ctx.Err() != nil {
+		res = job.errorResult(ctx.Err())
+	} else {
+		res = job.Run(ctx)
+	}
+	d.Lock()
+	key := job.Key()
+	if current := d.job(key); current != nil {
+		job = current
+	}
+	run := d.runs[key]
+	delete(d.runs, key)
+	run.cancel()
+	job.LastResult = res
+	// Prev is only advanced on success, so a failed job will be run again in anacron mode
+	if res.Error == "" {
+		job.Prev = scheduled
+	}
+	if err := d.db.Set(job.Key(), job.Value()); err != nil {
+		log.Printf("failed to save job %v: %v", job, err)
+	}
+	if err := d.db.AddHistory(res, historySize); err != nil {
+		log.Printf("failed to save job %v history: %v", job, err)
+	}
+	if run.queued && d.running && d.job(key) != nil {
+		d.startJob(job, run.scheduled)
+	}
+	d.Unlock()
+	if d.OnResult != nil {
+		d.OnResult(res)
+	}
+}
+
+// updateJobs parse the config and detect the next scheduled job,
+// the config and the jobs are only replaced if every job is valid.
+func (d *Scheduler) updateJobs(conf *Config) error {
 	d.Lock()
 	defer d.Unlock()
-	conf := GetConfig()
-	d.jobs = []*Job{}
-	for _, snap := range conf.Snapshots {
-		spec, err := cron.Parse(snap.Spec)
+	current := map[string]*Job{}
+	for _, job := range d.jobs {
+		current[job.Key()] = job
+	}
+	jobs := []*Job{}
+	for i := range conf.Snapshots {
+		entry := &conf.Snapshots[i]
+		spec, err := cron.Parse(entry.Spec)
 		if err != nil {
-			log.Printf("Bad spec %v: %v\naborting updateJobs", snap.Spec, err)
+			log.Printf("Bad spec %v: %v\naborting updateJobs", entry.Spec, err)
 			return err
 		}
-		job := NewJob(&snap, spec)
+		job := NewJob(entry, spec)
 		job.uploader = d.uploader
-		res, err := d.db.Get(nil, []byte(job.Key()))
-		if res == nil {
-			prev := time.Now().UTC()
-			if !job.Prev.IsZero() {
-				prev = job.Prev
-			}
-			job.ComputeNext(prev)
-		} else {
-			if err := ScanJob(job, string(res)); err != nil {
+		job.schedulerConfig = conf
+		res, err := d.db.Get(job.Key())
+		if err != nil {
+			return err
+		}
+		if res != "" {
+			if err := ScanJob(job, res); err != nil {
 				log.Printf("error scanning %v", err)
 				return err
 			}
+		}
+		switch prev, ok := current[job.Key()]; {
+		case ok:
+			// The schedule of an unchanged entry is kept, a run may still be in progress
+			// (Prev isn't updated yet), it must not be considered as a missed run
+			job.Next = prev.Next
+			job.started = prev.started
+		case res == "":
+			job.ComputeNext(time.Now().UTC())
+		default:
 			job.ComputeNext(job.Prev)
 		}
-		if err := d.db.Set([]byte(job.Key()), []byte(job.Value())); err != nil {
+		jobs = append(jobs, job)
+	}
+	d.config = conf
+	d.sem = newSem(conf.MaxConcurrentJobs)
+	d.jobs = jobs
+	for _, job := range jobs {
+		if err := d.db.Set(job.Key(), job.Value()); err != nil {
 			return err
 		}
-		d.jobs = append(d.jobs, job)
 	}
 	return nil
 }
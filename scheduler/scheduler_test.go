@@ -0,0 +1,102 @@
+package scheduler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+func TestScanJob(t *testing.T) {
+	prev := time.Date(2015, 3, 1, 10, 0, 0, 0, time.UTC)
+	next := prev.Add(12 * time.Hour)
+
+	// Value stored by older versions
+	job := &Job{config: &ConfigEntry{Path: "/tmp", Spec: "@every 12h"}}
+	if err := ScanJob(job, "2015-03-01T10:00:00Z 0"); err != nil {
+		t.Fatalf("failed to scan legacy value: %v", err)
+	}
+	if !job.Prev.Equal(prev) || !job.Next.IsZero() {
+		t.Errorf("bad legacy scan: %v", job)
+	}
+
+	job.Next = next
+	job.LastResult = &JobResult{Key: job.Key(), Error: "failed"}
+	job2 := &Job{config: job.config}
+	if err := ScanJob(job2, job.Value()); err != nil {
+		t.Fatalf("failed to scan value: %v", err)
+	}
+	if !job2.Prev.Equal(prev) || !job2.Next.Equal(next) || job2.LastResult == nil || job2.LastResult.Error != "failed" {
+		t.Errorf("bad scan: %v/%+v", job2, job2.LastResult)
+	}
+	state, err := scanState(job.Value())
+	if err != nil || state.Spec != "@every 12h" {
+		t.Errorf("bad state: %+v/%v", state, err)
+	}
+}
+
+func TestComputeNextAnacron(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second).Add(-time.Second)
+	job := &Job{
+		config:          &ConfigEntry{Path: "/tmp", Spec: "@every 1h"},
+		sched:           cron.ConstantDelaySchedule{Delay: time.Hour},
+		schedulerConfig: &Config{AnacronMode: true},
+		Prev:            now.Add(-2 * time.Hour),
+		Next:            now.Add(-time.Hour),
+	}
+	// At startup, the delay since the last successful run is exceeded, the job is run right away
+	job.ComputeNext(now)
+	if !job.Next.Equal(now) {
+		t.Errorf("missed run should be scheduled now, got %v", job.Next)
+	}
+	// Once started by the scheduler loop, the run isn't missed anymore even if Prev isn't updated yet
+	job.started = now
+	job.ComputeNext(now)
+	if expected := now.Add(time.Hour); !job.Next.Equal(expected) {
+		t.Errorf("next run should be %v, got %v", expected, job.Next)
+	}
+}
+
+func TestUpdateJobsReload(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "blobsnap-scheduler-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	db, err := newStateDB(filepath.Join(tempDir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Scheduler{runs: map[string]*jobRun{}, jobs: []*Job{}, db: db}
+	newConf := func() *Config {
+		return &Config{Snapshots: []ConfigEntry{{Path: "/tmp", Spec: "@every 1h"}}}
+	}
+	if err := d.updateJobs(newConf()); err != nil {
+		t.Fatal(err)
+	}
+	// A run in progress, Prev is only updated once it's done
+	now := time.Now().UTC()
+	job := d.jobs[0]
+	job.started = now
+	job.Next = now.Add(10 * time.Minute)
+	d.runs[job.Key()] = &jobRun{}
+	if err := d.updateJobs(newConf()); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded := d.jobs[0]; reloaded == job || !reloaded.Next.Equal(job.Next) || !reloaded.started.Equal(now) {
+		t.Errorf("the job schedule should be kept, got next %v (started %v), expected %v", reloaded.Next, reloaded.started, job.Next)
+	}
+
+	// An invalid config keeps the previous jobs
+	conf := newConf()
+	conf.Snapshots[0].Spec = "every hour"
+	if err := d.updateJobs(conf); err == nil {
+		t.Errorf("invalid spec should fail")
+	}
+	if len(d.jobs) != 1 || d.config.Snapshots[0].Spec != "@every 1h" {
+		t.Errorf("the previous jobs should be kept, got %v", d.jobs)
+	}
+}
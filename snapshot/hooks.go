@@ -0,0 +1,122 @@
+package snapshot
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Hooks holds the commands run around a snapshot (e.g. to dump or freeze a database),
+// commands are run with `sh -c` and the following environment variables:
+//
+//	BLOBSNAP_HOOK      pre, post or on-failure
+//	BLOBSNAP_PATH      the snapshot path
+//	BLOBSNAP_HOSTNAME  the snapshot hostname
+//	BLOBSNAP_REF       the snapshot meta ref (post hook only, unset if the upload failed)
+//	BLOBSNAP_ERROR     the error message (on-failure hook, and post hook if the upload failed)
+//
+// Once the pre hook has run, the post hook is always run (before the on-failure hook),
+// even if the upload fails or is canceled, so it can undo what the pre hook did.
+// The commands are killed if the snapshot is canceled, except the post/on-failure hooks
+// run after a failure (only bounded by Timeout).
+type Hooks struct {
+	Pre       string `json:"pre,omitempty"`
+	Post      string `json:"post,omitempty"`
+	OnFailure string `json:"on_failure,omitempty"`
+
+	// Timeout for each command (e.g. "5m"), no timeout if empty
+	Timeout string `json:"timeout,omitempty"`
+
+	// Additional environment variables
+	Env map[string]string `json:"env,omitempty"`
+
+	// OnError defines what happens when the pre/post command fails,
+	// "abort" (the default) or "mark" (the error is recorded in the snapshot)
+	OnError string `json:"on_error,omitempty"`
+}
+
+// Validate checks the timeout and the error policy.
+func (h *Hooks) Validate() error {
+	if _, err := h.timeout(); err != nil {
+		return err
+	}
+	switch h.OnError {
+	case "", "abort", "mark":
+	default:
+		return fmt.Errorf("invalid hook error policy %q, must be \"abort\" or \"mark\"", h.OnError)
+	}
+	return nil
+}
+
+func (h *Hooks) timeout() (time.Duration, error) {
+	if h.Timeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(h.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid hook timeout %q: %v", h.Timeout, err)
+	}
+	return timeout, nil
+}
+
+// abort returns true if the snapshot must be aborted when a pre/post command fails.
+func (h *Hooks) abort() bool {
+	return h.OnError != "mark"
+}
+
+// run executes the given hook command (if any) with the snapshot infos in its environment,
+// the command is killed if the context is canceled.
+func (h *Hooks) run(ctx context.Context, hook, command string, env map[string]string) error {
+	if command == "" {
+		return nil
+	}
+	timeout, err := h.timeout()
+	if err != nil {
+		return err
+	}
+	log.Printf("Running %v hook: %v", hook, command)
+	cmd := exec.Command("sh", "-c", command)
+	// Keep stdout clean for the CLI output
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	// Run the command in its own process group, so its children can be killed on timeout/cancel
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = append(os.Environ(), fmt.Sprintf("BLOBSNAP_HOOK=%v", hook))
+	for k, v := range h.Env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%v=%v", k, v))
+	}
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%v=%v", k, v))
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%v hook failed: %v", hook, err)
+	}
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			log.Printf("%v hook timed out after %v, killing it", hook, timeout)
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+		defer timer.Stop()
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%v hook canceled: %v", hook, ctx.Err())
+		}
+		return fmt.Errorf("%v hook failed: %v", hook, err)
+	}
+	return nil
+}
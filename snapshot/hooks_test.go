@@ -0,0 +1,106 @@
+package snapshot
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tsileo/blobsnap/clientutil"
+	"golang.org/x/net/context"
+)
+
+func TestHooks(t *testing.T) {
+	h := &Hooks{
+		Env: map[string]string{"DBNAME": "blog"},
+	}
+	env := map[string]string{"BLOBSNAP_PATH": "/var/backups"}
+	if err := h.run(context.Background(), "pre", `test "$BLOBSNAP_HOOK" = pre && test "$BLOBSNAP_PATH" = /var/backups && test "$DBNAME" = blog`, env); err != nil {
+		t.Errorf("hook should succeed: %v", err)
+	}
+	if err := h.run(context.Background(), "post", "exit 1", env); err == nil {
+		t.Errorf("hook should fail")
+	}
+	if err := h.run(context.Background(), "post", "", env); err != nil {
+		t.Errorf("empty hook should be a no-op: %v", err)
+	}
+
+	h.Timeout = "100ms"
+	start := time.Now()
+	if err := h.run(context.Background(), "pre", "sleep 5", env); err == nil {
+		t.Errorf("hook should time out")
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Errorf("hook should have been killed")
+	}
+
+	// Killed when the snapshot is canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := (&Hooks{}).run(ctx, "pre", "sleep 5", env); err == nil {
+		t.Errorf("hook should be canceled")
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Errorf("hook should have been killed on cancel")
+	}
+
+	if err := (&Hooks{Timeout: "1 minute"}).Validate(); err == nil {
+		t.Errorf("bad timeout should not validate")
+	}
+	if err := (&Hooks{OnError: "ignore"}).Validate(); err == nil {
+		t.Errorf("bad error policy should not validate")
+	}
+	if err := (&Hooks{Timeout: "5m", OnError: "mark"}).Validate(); err != nil {
+		t.Errorf("hooks should validate: %v", err)
+	}
+}
+
+func TestHooksUploadFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobsnap-hooks-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logPath := filepath.Join(dir, "log")
+	opts := &PutOptions{Hooks: &Hooks{
+		Pre:       "echo pre >> " + logPath,
+		Post:      `echo "post $BLOBSNAP_ERROR" >> ` + logPath,
+		OnFailure: "echo on-failure >> " + logPath,
+	}}
+	up := &Uploader{Hostname: "test"}
+	upload := func(ctx context.Context) (*clientutil.Meta, *clientutil.WriteResult, error) {
+		return nil, nil, errors.New("upload failed")
+	}
+	if _, _, err := up.put(context.Background(), "/data", nil, opts, upload); err == nil {
+		t.Fatalf("put should fail")
+	}
+	out, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The post hook undoes the pre hook before the on-failure hook runs
+	if expected := "pre\npost upload failed\non-failure\n"; string(out) != expected {
+		t.Errorf("hooks ran %q, expected %q", out, expected)
+	}
+
+	// The cleanup still runs once the snapshot is canceled
+	os.Remove(logPath)
+	ctx, cancel := context.WithCancel(context.Background())
+	upload = func(ctx context.Context) (*clientutil.Meta, *clientutil.WriteResult, error) {
+		cancel()
+		return nil, nil, ctx.Err()
+	}
+	if _, _, err := up.put(ctx, "/data", nil, opts, upload); err == nil {
+		t.Fatalf("put should fail")
+	}
+	out, err = ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "pre\npost context canceled\non-failure\n"; string(out) != expected {
+		t.Errorf("hooks ran %q after cancel, expected %q", out, expected)
+	}
+}
@@ -0,0 +1,62 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tsileo/blobstash/client"
+)
+
+// SnapSets returns the latest Snapshot of every snapset.
+func SnapSets(kvs *client.KvStore) ([]*Snapshot, error) {
+	keys, err := kvs.Keys("blobsnap:snapset:", "blobsnap:snapset:\xff", 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed kvs.Keys: %v", err)
+	}
+	snaps := []*Snapshot{}
+	for _, kv := range keys {
+		snap := &Snapshot{}
+		if err := json.Unmarshal([]byte(kv.Value), snap); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal: %v", err)
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
+
+// Versions returns every versions of the given snapset (oldest first).
+func Versions(kvs *client.KvStore, key string) ([]*Snapshot, error) {
+	res, err := kvs.Versions(fmt.Sprintf("blobsnap:snapset:%v", key), 0, int(time.Now().UTC().UnixNano()), 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed kvs.Versions: %v", err)
+	}
+	snaps := []*Snapshot{}
+	for _, kv := range res.Versions {
+		snap := &Snapshot{}
+		if err := json.Unmarshal([]byte(kv.Value), snap); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal: %v", err)
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
+
+// Latest returns the latest version of the snapset matching the given tags,
+// or nil if there is no such version.
+func Latest(kvs *client.KvStore, key string, tags map[string]string) (*Snapshot, error) {
+	snaps, err := Versions(kvs, key)
+	if err != nil {
+		return nil, err
+	}
+	var latest *Snapshot
+	for _, snap := range snaps {
+		if !snap.MatchTags(tags) {
+			continue
+		}
+		if latest == nil || snap.Time >= latest.Time {
+			latest = snap
+		}
+	}
+	return latest, nil
+}
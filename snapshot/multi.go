@@ -0,0 +1,142 @@
+package snapshot
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dchest/blake2b"
+	"github.com/tsileo/blobsnap/clientutil"
+	"golang.org/x/net/context"
+)
+
+// MultiPath returns the virtual path of a snapshot covering several paths.
+func MultiPath(name string) string {
+	return "multi:" + name
+}
+
+// MultiName returns the default name of a snapshot covering the given paths, their sorted
+// base names joined with "+" followed by a hash of their absolute paths (e.g. app+etc+home-1a2b3c4d),
+// so different paths with the same base names are not saved in the same snapset.
+func MultiName(paths []string) string {
+	roots, err := multiRoots(paths)
+	if err != nil {
+		// Rejected by PutPaths anyway
+		roots = paths
+	}
+	hash := blake2b.Sum256([]byte(strings.Join(roots, "\n")))
+	return fmt.Sprintf("%v-%x", baseNames(roots), hash[:4])
+}
+
+// baseNames returns the sorted base names of the paths joined with "+".
+func baseNames(paths []string) string {
+	names := []string{}
+	for _, path := range paths {
+		names = append(names, filepath.Base(path))
+	}
+	sort.Strings(names)
+	return strings.Join(names, "+")
+}
+
+// CheckPaths returns an error if the paths can't be snapshotted together.
+func CheckPaths(paths []string) error {
+	_, err := multiRoots(paths)
+	return err
+}
+
+// multiRoots returns the sorted absolute paths, the paths can't contain each other.
+func multiRoots(paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no paths to snapshot")
+	}
+	roots := []string{}
+	for _, path := range paths {
+		root, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		if root == "/" {
+			return nil, fmt.Errorf("/ can't be part of a multi-paths snapshot")
+		}
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+	for i, root := range roots {
+		for _, other := range roots[i+1:] {
+			if root == other || strings.HasPrefix(other, root+"/") {
+				return nil, fmt.Errorf("%v is already included in %v", other, root)
+			}
+		}
+	}
+	return roots, nil
+}
+
+// PutPaths uploads several files/directories (e.g. /etc, /home and /var/lib/app) as a single Snapshot,
+// saved with a virtual path ("multi:<name>", name defaults to MultiName).
+// The paths are stored in a virtual directory named name (or their base names joined with "+"),
+// mirroring their absolute paths (e.g. etc/, home/ and var/lib/app/).
+func (up *Uploader) PutPaths(name string, paths []string, opts *PutOptions) (*Snapshot, *clientutil.Meta, error) {
+	return up.PutPathsContext(context.Background(), name, paths, opts)
+}
+
+// PutPathsContext is like PutPaths, but the upload is stopped if the context is canceled.
+func (up *Uploader) PutPathsContext(ctx context.Context, name string, paths []string, opts *PutOptions) (*Snapshot, *clientutil.Meta, error) {
+	roots, err := multiRoots(paths)
+	if err != nil {
+		return nil, nil, err
+	}
+	dirName := name
+	if name == "" {
+		name = MultiName(roots)
+		dirName = baseNames(roots)
+	}
+	return up.put(ctx, MultiPath(name), roots, opts, func(ctx context.Context) (*clientutil.Meta, *clientutil.WriteResult, error) {
+		wr := clientutil.NewWriteResult()
+		meta, err := up.putTree(ctx, dirName, "/", roots, opts, wr)
+		if err != nil {
+			return nil, nil, err
+		}
+		return meta, wr, nil
+	})
+}
+
+// putTree uploads the roots located below dir, and returns the Meta of the virtual directory
+// containing them (or the directories leading to them).
+func (up *Uploader) putTree(ctx context.Context, name, dir string, roots []string, opts *PutOptions, wr *clientutil.WriteResult) (*clientutil.Meta, error) {
+	// Group the roots by child of dir
+	children := []string{}
+	childRoots := map[string][]string{}
+	for _, root := range roots {
+		rel := strings.TrimPrefix(strings.TrimPrefix(root, dir), "/")
+		child := filepath.Join(dir, strings.SplitN(rel, "/", 2)[0])
+		if _, ok := childRoots[child]; !ok {
+			children = append(children, child)
+		}
+		childRoots[child] = append(childRoots[child], root)
+	}
+	metas := []*clientutil.Meta{}
+	for _, child := range children {
+		croots := childRoots[child]
+		if len(croots) == 1 && croots[0] == child {
+			meta, cwr, err := up.upload(ctx, child, opts)
+			if err != nil {
+				return nil, err
+			}
+			wr.Add(cwr)
+			metas = append(metas, meta)
+			continue
+		}
+		meta, err := up.putTree(ctx, filepath.Base(child), child, croots, opts, wr)
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+	meta, vwr, err := up.Uploader.PutVirtualDir(name, metas)
+	if err != nil {
+		return nil, err
+	}
+	wr.Add(vwr)
+	return meta, nil
+}
@@ -0,0 +1,47 @@
+package snapshot
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMultiRoots(t *testing.T) {
+	roots, err := multiRoots([]string{"/var/lib/app", "/etc/", "/home"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/etc", "/home", "/var/lib/app"}
+	if len(roots) != len(expected) {
+		t.Fatalf("bad roots %v, expected %v", roots, expected)
+	}
+	for i, root := range roots {
+		if root != expected[i] {
+			t.Errorf("bad roots %v, expected %v", roots, expected)
+		}
+	}
+	name := MultiName(roots)
+	if !strings.HasPrefix(name, "app+etc+home-") {
+		t.Errorf("bad name %q", name)
+	}
+	if other := MultiName([]string{"/home/", "/etc", "/var/lib/app"}); other != name {
+		t.Errorf("the name should only depend on the roots, got %q and %q", name, other)
+	}
+	// Same base names, but different paths
+	if other := MultiName([]string{"/srv/lib/app", "/srv/etc", "/srv/home"}); other == name {
+		t.Errorf("different paths should have different names, got %q", other)
+	}
+	for _, paths := range [][]string{
+		{},
+		{"/etc", "/"},
+		{"/etc", "/etc"},
+		{"/var", "/var/lib/app"},
+	} {
+		if _, err := multiRoots(paths); err == nil {
+			t.Errorf("paths %v should be rejected", paths)
+		}
+	}
+	// Not nested, even if /var/lib/app-data starts with /var/lib/app
+	if _, err := multiRoots([]string{"/var/lib/app", "/var/lib/app-data"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
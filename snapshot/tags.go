@@ -0,0 +1,50 @@
+package snapshot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ParseTag parses a "key=value" tag.
+func ParseTag(tag string) (string, string, error) {
+	parts := strings.SplitN(tag, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("invalid tag %q, expected key=value", tag)
+	}
+	return parts[0], parts[1], nil
+}
+
+// ParseTags parses a list of "key=value" tags.
+func ParseTags(tags []string) (map[string]string, error) {
+	res := map[string]string{}
+	for _, tag := range tags {
+		k, v, err := ParseTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		res[k] = v
+	}
+	return res, nil
+}
+
+// MatchTags returns true if the Snapshot has all the given tags.
+func (s *Snapshot) MatchTags(tags map[string]string) bool {
+	for k, v := range tags {
+		sv, ok := s.Tags[k]
+		if !ok || sv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// TagList returns the tags as a sorted list of "key=value".
+func (s *Snapshot) TagList() []string {
+	res := []string{}
+	for k, v := range s.Tags {
+		res = append(res, fmt.Sprintf("%v=%v", k, v))
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,33 @@
+package snapshot
+
+import "testing"
+
+func TestTags(t *testing.T) {
+	tags, err := ParseTags([]string{"env=prod", "reason=before upgrade", "empty="})
+	if err != nil {
+		t.Fatalf("failed to parse tags: %v", err)
+	}
+	if len(tags) != 3 || tags["reason"] != "before upgrade" || tags["empty"] != "" {
+		t.Errorf("bad tags: %+v", tags)
+	}
+	for _, bad := range []string{"env", "=prod"} {
+		if _, err := ParseTags([]string{bad}); err == nil {
+			t.Errorf("tag %q should be invalid", bad)
+		}
+	}
+	snap := &Snapshot{Tags: tags}
+	if !snap.MatchTags(map[string]string{"env": "prod"}) {
+		t.Errorf("snapshot should match env=prod")
+	}
+	if snap.MatchTags(map[string]string{"env": "dev"}) {
+		t.Errorf("snapshot should not match env=dev")
+	}
+	// Snapshots created before tags support
+	old := &Snapshot{}
+	if !old.MatchTags(nil) || old.MatchTags(tags) {
+		t.Errorf("untagged snapshot should only match an empty filter")
+	}
+	if l := snap.TagList(); len(l) != 3 || l[0] != "empty=" || l[1] != "env=prod" {
+		t.Errorf("bad tag list: %v", l)
+	}
+}
@@ -3,20 +3,29 @@ package snapshot
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/dchest/blake2b"
 	"github.com/tsileo/blobsnap/clientutil"
+	"github.com/tsileo/blobsnap/fssnap"
 	"github.com/tsileo/blobstash/client"
+	"golang.org/x/net/context"
 )
 
 type Uploader struct {
 	bs       *client.BlobStore
 	kvs      *client.KvStore
 	Uploader *clientutil.Uploader
+
+	// Hostname overrides the real hostname (used to split snapshots into a different bucket)
+	Hostname string
 }
 
 func NewUploader(serverAddr string) (*Uploader, error) {
@@ -35,14 +44,32 @@ func (up *Uploader) Close() error {
 	return nil
 }
 
+// hostname returns the hostname override if set, the real hostname otherwise.
+func (up *Uploader) hostname() (string, error) {
+	if up.Hostname != "" {
+		return up.Hostname, nil
+	}
+	return os.Hostname()
+}
+
 type Snapshot struct {
-	Path        string                  `json:"path"`
-	Hostname    string                  `json:"hostname"`
-	Ref         string                  `json:"ref"`
-	Time        int                     `json:"time"`
-	SnapSetKey  string                  `json:"key"`
-	Comment     string                  `json:"comment,omitempty"`
-	WriteResult *clientutil.WriteResult `json:"wr"`
+	Path         string                     `json:"path"`
+	Paths        []string                   `json:"paths,omitempty"`
+	Hostname     string                     `json:"hostname"`
+	Ref          string                     `json:"ref"`
+	Time         int                        `json:"time"`
+	SnapSetKey   string                     `json:"key"`
+	Comment      string                     `json:"comment,omitempty"`
+	Tags         map[string]string          `json:"tags,omitempty"`
+	HookErrors   []string                   `json:"hook_errors,omitempty"`
+	Errors       []string                   `json:"errors,omitempty"`
+	Partial      bool                       `json:"partial,omitempty"`
+	Inconsistent []string                   `json:"inconsistent,omitempty"`
+	Excluded     []*clientutil.ExcludedPath `json:"excluded,omitempty"`
+	WriteResult  *clientutil.WriteResult    `json:"wr"`
+
+	// Created is false if the snapshot hasn't been saved (nothing has been uploaded)
+	Created bool `json:"-"`
 }
 
 func (s *Snapshot) ComputeSnapSetKey() string {
@@ -64,38 +91,286 @@ func (s *Snapshot) FetchMeta(bs *client.BlobStore) (*clientutil.Meta, error) {
 	return m, nil
 }
 
-func (up *Uploader) Put(path string) (*clientutil.Meta, error) {
+// PutOptions holds the optional infos stored along with a Snapshot,
+// and the hooks to run around it (once the pre hook has run, the post hook
+// is always run, even if the upload fails or is canceled).
+type PutOptions struct {
+	Comment string
+	Tags    map[string]string
+	Hooks   *Hooks
+
+	// FSSnapshot is the name of the filesystem snapshot provider (see the fssnap package),
+	// if set, the backup is made from a point-in-time snapshot of the path
+	FSSnapshot string
+
+	// Excludes defines the files/directories left out of the snapshot (in addition to the ignore files)
+	Excludes *clientutil.Excludes
+
+	// RecordExcluded stores the excluded paths (and the rule that excluded them) in the Snapshot
+	RecordExcluded bool
+
+	// Sparse stores the regions of zeros of the files as holes (e.g. for VM images)
+	Sparse bool
+}
+
+// uploadFunc performs the actual upload of a snapshot.
+type uploadFunc func(ctx context.Context) (*clientutil.Meta, *clientutil.WriteResult, error)
+
+// Put uploads the file/directory and saves a new Snapshot in its snapset.
+// If nothing has been uploaded, the returned Snapshot is not saved.
+func (up *Uploader) Put(path string, opts *PutOptions) (*Snapshot, *clientutil.Meta, error) {
+	return up.PutContext(context.Background(), path, opts)
+}
+
+// PutContext is like Put, but the upload is stopped if the context is canceled.
+func (up *Uploader) PutContext(ctx context.Context, path string, opts *PutOptions) (*Snapshot, *clientutil.Meta, error) {
+	return up.put(ctx, filepath.Clean(path), nil, opts, func(ctx context.Context) (*clientutil.Meta, *clientutil.WriteResult, error) {
+		return up.upload(ctx, path, opts)
+	})
+}
+
+// upload uploads the file/directory (from a filesystem snapshot if needed).
+func (up *Uploader) upload(ctx context.Context, path string, opts *PutOptions) (*clientutil.Meta, *clientutil.WriteResult, error) {
+	// Upload from the filesystem snapshot, the Snapshot still records the original path
+	if opts != nil && opts.FSSnapshot != "" {
+		fsnap, err := fssnap.Create(opts.FSSnapshot, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer func() {
+			if err := fsnap.Remove(); err != nil {
+				log.Printf("failed to remove the %v snapshot %v: %v", opts.FSSnapshot, fsnap.Path, err)
+			}
+		}()
+		path = fsnap.Path
+	}
 	info, err := os.Stat(path)
-	if os.IsNotExist(err) {
-		return nil, err
+	if err != nil {
+		return nil, nil, err
 	}
-	var meta *clientutil.Meta
-	var wr *clientutil.WriteResult
 	if info.IsDir() {
-		meta, wr, err = up.Uploader.PutDir(path)
-	} else {
-		meta, wr, err = up.Uploader.PutFile(path)
+		return up.uploader(opts).PutDirContext(ctx, path)
+	}
+	return up.uploader(opts).PutFileContext(ctx, path)
+}
+
+// uploader returns a copy of the clientutil.Uploader configured with the options,
+// as the Uploader may be shared by concurrent snapshots (e.g. by the scheduler).
+func (up *Uploader) uploader(opts *PutOptions) *clientutil.Uploader {
+	dup := up.Uploader.Copy()
+	if opts != nil {
+		dup.Excludes = opts.Excludes
+		if opts.Sparse {
+			dup.Sparse = true
+		}
+		if opts.RecordExcluded {
+			dup.RecordExcluded = true
+		}
 	}
+	return dup
+}
+
+// PutReader uploads the content of the reader as a file named name (e.g. a database dump piped to stdin),
+// and saves a new Snapshot with a virtual path ("stdin:<name>").
+func (up *Uploader) PutReader(name string, reader io.ReadCloser, opts *PutOptions) (*Snapshot, *clientutil.Meta, error) {
+	return up.PutReaderContext(context.Background(), name, reader, opts)
+}
+
+// PutReaderContext is like PutReader, but the upload is stopped if the context is canceled.
+func (up *Uploader) PutReaderContext(ctx context.Context, name string, reader io.ReadCloser, opts *PutOptions) (*Snapshot, *clientutil.Meta, error) {
+	return up.put(ctx, StdinPath(name), nil, opts, func(ctx context.Context) (*clientutil.Meta, *clientutil.WriteResult, error) {
+		return up.uploader(opts).PutReaderContext(ctx, name, reader)
+	})
+}
+
+// PutTar imports the tar archive (optionally gzip'ed) read from r, with the same tree as PutDir
+// would upload for the extracted archive, and saves a new Snapshot with a virtual path ("tar:<name>").
+func (up *Uploader) PutTar(name string, r io.Reader, opts *PutOptions) (*Snapshot, *clientutil.Meta, error) {
+	return up.PutTarContext(context.Background(), name, r, opts)
+}
+
+// PutTarContext is like PutTar, but the upload is stopped if the context is canceled.
+func (up *Uploader) PutTarContext(ctx context.Context, name string, r io.Reader, opts *PutOptions) (*Snapshot, *clientutil.Meta, error) {
+	root := tarRoot(name)
+	return up.put(ctx, TarPath(name), nil, opts, func(ctx context.Context) (*clientutil.Meta, *clientutil.WriteResult, error) {
+		return up.uploader(opts).PutTarContext(ctx, root, r)
+	})
+}
+
+// tarRoot returns the name of the root directory of an archive with several top-level entries,
+// i.e. the archive name without its extension.
+func tarRoot(name string) string {
+	root := filepath.Base(name)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar"} {
+		if strings.HasSuffix(root, ext) && root != ext {
+			return strings.TrimSuffix(root, ext)
+		}
+	}
+	return root
+}
+
+// PutCommand runs the command with `sh -c` and uploads its output like PutReader,
+// the snapshot is aborted if the command fails.
+func (up *Uploader) PutCommand(name, command string, opts *PutOptions) (*Snapshot, *clientutil.Meta, error) {
+	return up.PutCommandContext(context.Background(), name, command, opts)
+}
+
+// PutCommandContext is like PutCommand, but the command is killed if the context is canceled.
+func (up *Uploader) PutCommandContext(ctx context.Context, name, command string, opts *PutOptions) (*Snapshot, *clientutil.Meta, error) {
+	return up.put(ctx, StdinPath(name), nil, opts, func(ctx context.Context) (*clientutil.Meta, *clientutil.WriteResult, error) {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stderr = os.Stderr
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, nil, fmt.Errorf("failed to run %q: %v", command, err)
+		}
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			case <-done:
+			}
+		}()
+		meta, wr, err := up.uploader(opts).PutReaderContext(ctx, name, stdout)
+		if err != nil {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			cmd.Wait()
+			return nil, nil, err
+		}
+		if err := cmd.Wait(); err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			return nil, nil, fmt.Errorf("command %q failed: %v", command, err)
+		}
+		return meta, wr, nil
+	})
+}
+
+// TarPath returns the virtual path of a snapshot imported from a tar archive.
+func TarPath(name string) string {
+	return "tar:" + name
+}
+
+// StdinPath returns the virtual path of a snapshot created from a stream.
+func StdinPath(name string) string {
+	return "stdin:" + name
+}
+
+// put runs the hooks around the upload, and saves the Snapshot
+// (paths are the roots of a multi-paths snapshot, nil otherwise).
+func (up *Uploader) put(ctx context.Context, path string, paths []string, opts *PutOptions, upload uploadFunc) (*Snapshot, *clientutil.Meta, error) {
+	if opts == nil {
+		opts = &PutOptions{}
+	}
+	hooks := opts.Hooks
+	if hooks == nil {
+		hooks = &Hooks{}
+	}
+	hostname, err := up.hostname()
 	if err != nil {
-		return meta, err
+		return nil, nil, err
 	}
-	if wr.SizeUploaded == 0 {
-		log.Println("Nothing has been uploaded, no snapshot will be created.")
-		return meta, nil
+	env := map[string]string{
+		"BLOBSNAP_PATH":     path,
+		"BLOBSNAP_HOSTNAME": hostname,
+	}
+	// Once the pre hook has run, the post hook must run to undo it (e.g. unfreeze a filesystem)
+	preRun, postRun := false, false
+	post := func(ctx context.Context) error {
+		err := hooks.run(ctx, "post", hooks.Post, env)
+		// Killed by the cancellation, it must be run again
+		postRun = ctx.Err() == nil
+		return err
+	}
+	// Run the post hook (if not run yet) and the on-failure hook before returning the error,
+	// they're not canceled with the snapshot so the cleanup is done
+	fail := func(err error) (*Snapshot, *clientutil.Meta, error) {
+		env["BLOBSNAP_ERROR"] = err.Error()
+		if preRun && !postRun {
+			if herr := post(context.Background()); herr != nil {
+				log.Printf("%v", herr)
+			}
+		}
+		if herr := hooks.run(context.Background(), "on-failure", hooks.OnFailure, env); herr != nil {
+			log.Printf("%v", herr)
+		}
+		return nil, nil, err
 	}
-	hostname, err := os.Hostname()
+	hookErrors := []string{}
+	if err := hooks.run(ctx, "pre", hooks.Pre, env); err != nil {
+		if hooks.abort() {
+			return fail(err)
+		}
+		hookErrors = append(hookErrors, err.Error())
+	}
+	preRun = true
+	meta, wr, err := upload(ctx)
 	if err != nil {
-		return nil, err
+		return fail(err)
+	}
+	// Never save a snapshot for a canceled upload
+	if err := ctx.Err(); err != nil {
+		return fail(err)
+	}
+	env["BLOBSNAP_REF"] = meta.Hash
+	if err := post(ctx); err != nil {
+		if hooks.abort() {
+			return fail(err)
+		}
+		hookErrors = append(hookErrors, err.Error())
 	}
+	if err := ctx.Err(); err != nil {
+		return fail(err)
+	}
+	snap, err := up.saveSnapshot(path, paths, hostname, meta, wr, opts, hookErrors)
+	if err != nil {
+		return fail(err)
+	}
+	return snap, meta, nil
+}
+
+// saveSnapshot creates a new Snapshot for the uploaded Meta and saves it in its snapset,
+// unless nothing has been uploaded (and there is no comment/tags to record).
+func (up *Uploader) saveSnapshot(path string, paths []string, hostname string, meta *clientutil.Meta, wr *clientutil.WriteResult, opts *PutOptions, hookErrors []string) (*Snapshot, error) {
 	t := time.Now().UTC()
 	snap := &Snapshot{
-		Path:        filepath.Clean(path),
+		Path:        path,
+		Paths:       paths,
 		Hostname:    hostname,
 		Ref:         meta.Hash,
 		Time:        int(t.Unix()),
+		Comment:     opts.Comment,
+		Tags:        opts.Tags,
 		WriteResult: wr,
 	}
+	if len(hookErrors) > 0 {
+		snap.HookErrors = hookErrors
+	}
+	// Some files were unreadable and have been skipped
+	if len(wr.Errors) > 0 {
+		snap.Errors = wr.Errors
+		snap.Partial = true
+	}
+	// Files modified during the upload (their content may be inconsistent)
+	if len(wr.Inconsistent) > 0 {
+		snap.Inconsistent = wr.Inconsistent
+	}
+	if opts.RecordExcluded && len(wr.Excluded) > 0 {
+		snap.Excluded = wr.Excluded
+	}
 	snap.SnapSetKey = snap.ComputeSnapSetKey()
+	// A version is still saved for an unchanged tree if it carries a comment or tags
+	if wr.SizeUploaded == 0 && opts.Comment == "" && len(opts.Tags) == 0 {
+		log.Println("Nothing has been uploaded, no snapshot will be created.")
+		return snap, nil
+	}
 	snapjs, err := json.Marshal(snap)
 	if err != nil {
 		return nil, err
@@ -104,5 +379,6 @@ func (up *Uploader) Put(path string) (*clientutil.Meta, error) {
 	if err != nil {
 		return nil, err
 	}
-	return meta, nil
+	snap.Created = true
+	return snap, nil
 }
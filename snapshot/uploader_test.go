@@ -0,0 +1,18 @@
+package snapshot
+
+import "testing"
+
+func TestTarRoot(t *testing.T) {
+	for name, expected := range map[string]string{
+		"backup.tar":         "backup",
+		"/tmp/backup.tar.gz": "backup",
+		"backup.tgz":         "backup",
+		"backup.2015-05-12":  "backup.2015-05-12",
+		"dir/.tar":           ".tar",
+		"archive.tar.tar.gz": "archive.tar",
+	} {
+		if root := tarRoot(name); root != expected {
+			t.Errorf("%q: root %q, expected %q", name, root, expected)
+		}
+	}
+}
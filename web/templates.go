@@ -0,0 +1,115 @@
+package web
+
+import (
+	"html/template"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+var templates = template.Must(template.New("web").Funcs(template.FuncMap{
+	// link builds an escaped URL path from its components
+	"link": func(elems ...string) string {
+		u := &url.URL{Path: path.Join(elems...)}
+		return u.String()
+	},
+	"size": func(size int) string {
+		return humanize.Bytes(uint64(size))
+	},
+	"unix": func(t int) string {
+		return time.Unix(int64(t), 0).Format(time.RFC3339)
+	},
+}).Parse(layout))
+
+const layout = `
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>BlobSnap</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.2em 1em 0.2em 0; }
+.ref { font-family: monospace; }
+</style>
+</head>
+<body>
+<h1><a href="/">BlobSnap</a></h1>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "hosts"}}{{template "header"}}
+{{range .}}
+<h2><a href="{{link "/hosts" .Hostname}}">{{.Hostname}}</a></h2>
+{{template "snapsets" .SnapSets}}
+{{else}}
+<p>No snapshots.</p>
+{{end}}
+{{template "footer"}}{{end}}
+
+{{define "host"}}{{template "header"}}
+<h2>{{.Hostname}}</h2>
+{{template "snapsets" .SnapSets}}
+{{template "footer"}}{{end}}
+
+{{define "snapsets"}}<table>
+<tr><th>Path</th><th>Latest snapshot</th><th>Size</th><th>Versions</th></tr>
+{{range .}}<tr>
+<td><a href="{{link "/browse" .Ref}}/">{{.Path}}</a></td>
+<td>{{unix .Time}}</td>
+<td>{{if .WriteResult}}{{size .WriteResult.Size}}{{end}}</td>
+<td><a href="{{link "/snapsets" .SnapSetKey}}">versions</a></td>
+</tr>
+{{end}}</table>
+{{end}}
+
+{{define "snapset"}}{{template "header"}}
+<h2><a href="{{link "/hosts" .Hostname}}">{{.Hostname}}</a>: {{.Path}}</h2>
+<table>
+<tr><th>Time</th><th>Ref</th><th>Size</th><th>Tags</th><th>Comment</th></tr>
+{{range .Versions}}<tr>
+<td><a href="{{link "/browse" .Ref}}/">{{unix .Time}}</a></td>
+<td class="ref">{{.Ref}}</td>
+<td>{{if .WriteResult}}{{size .WriteResult.Size}}{{end}}</td>
+<td>{{range .TagList}}{{.}} {{end}}</td>
+<td>{{.Comment}}{{if .Partial}} (partial){{end}}</td>
+</tr>
+{{end}}</table>
+{{template "footer"}}{{end}}
+
+{{define "browse"}}{{template "header"}}
+{{$ref := .Ref}}
+<h2 class="ref">{{range .Crumbs}}<a href="{{link "/browse" $ref .Path}}/">{{.Name}}</a> {{end}}</h2>
+{{if eq .Entry.Type "dir"}}
+<p>Download as <a href="{{link "/download" $ref .Path}}?format=zip">zip</a>,
+<a href="{{link "/download" $ref .Path}}?format=tar.gz">tar.gz</a> or
+<a href="{{link "/download" $ref .Path}}?format=tar">tar</a></p>
+<table>
+<tr><th>Name</th><th>Size</th><th>Mode</th><th>Modified</th><th></th></tr>
+{{$path := .Path}}
+{{range .Entries}}<tr>
+<td><a href="{{link "/browse" $ref $path .Name}}{{if eq .Type "dir"}}/{{end}}">{{.Name}}{{if eq .Type "dir"}}/{{end}}</a></td>
+<td>{{if eq .Type "file"}}{{size .Size}}{{end}}</td>
+<td>{{.Mode}}</td>
+<td>{{.ModTime}}</td>
+<td>{{if eq .Type "file"}}<a href="{{link "/download" $ref $path .Name}}">download</a>{{end}}</td>
+</tr>
+{{end}}</table>
+{{else}}{{with .Entry}}
+<table>
+<tr><th>Size</th><td>{{size .Size}}</td></tr>
+<tr><th>Mode</th><td>{{.Mode}}</td></tr>
+<tr><th>Modified</th><td>{{.ModTime}}</td></tr>
+<tr><th>Ref</th><td class="ref">{{.Ref}}</td></tr>
+</table>
+{{end}}
+<p><a href="{{link "/download" $ref .Path}}">Download</a></p>
+{{end}}
+{{template "footer"}}{{end}}
+`
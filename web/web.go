@@ -0,0 +1,377 @@
+/*
+Package web implements a read-only web UI and JSON API to browse and download the snapshots,
+an alternative to the FUSE file system that only requires a browser (or an HTTP client).
+
+Every page has a JSON counterpart under /api:
+
+- / (/api/hosts): the hosts and their snapsets.
+- /hosts/{hostname} (/api/hosts/{hostname}): the snapsets of the host.
+- /snapsets/{key} (/api/snapsets/{key}): the versions of the snapset (most recent first).
+- /browse/{ref}/{path} (/api/browse/{ref}/{path}): the file/directory located at path in the snapshot ref.
+
+Files are downloaded from /download/{ref}/{path} (with Range support), and directories as an archive
+built on the fly, with ?format=zip (the default), tar or tar.gz.
+*/
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tsileo/blobsnap/clientutil"
+	"github.com/tsileo/blobsnap/snapshot"
+	"github.com/tsileo/blobstash/client"
+)
+
+var errNotFound = errors.New("not found")
+
+// Server serves the web UI and the JSON API.
+type Server struct {
+	bs  *client.BlobStore
+	kvs *client.KvStore
+	mux *http.ServeMux
+}
+
+// New returns a Server browsing the snapshots stored on the given BlobStash server.
+func New(serverAddr string) *Server {
+	s := &Server{
+		bs:  client.NewBlobStore(serverAddr),
+		kvs: client.NewKvStore(serverAddr),
+		mux: http.NewServeMux(),
+	}
+	s.handle("/", "/api/hosts", "hosts", s.hosts)
+	s.handle("/hosts/", "/api/hosts/", "host", s.host)
+	s.handle("/snapsets/", "/api/snapsets/", "snapset", s.snapset)
+	s.handle("/browse/", "/api/browse/", "browse", s.browse)
+	s.mux.HandleFunc("/download/", s.download)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves the web UI on addr.
+func (s *Server) ListenAndServe(addr string) error {
+	log.Printf("Serving the web UI on http://%v/\nCtrl+C to stop.", addr)
+	return http.ListenAndServe(addr, s)
+}
+
+// pageFunc returns the data of a page given the path following its prefix.
+type pageFunc func(p string) (interface{}, error)
+
+// handle registers the page (rendered with the named template) and its JSON counterpart.
+func (s *Server) handle(prefix, apiPrefix, tmpl string, fn pageFunc) {
+	s.mux.HandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r) {
+			return
+		}
+		data, err := fn(strings.TrimPrefix(r.URL.Path, prefix))
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := templates.ExecuteTemplate(w, tmpl, data); err != nil {
+			log.Printf("web: failed to render %v: %v", r.URL.Path, err)
+		}
+	})
+	s.mux.HandleFunc(apiPrefix, func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r) {
+			return
+		}
+		data, err := fn(strings.TrimPrefix(r.URL.Path, apiPrefix))
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(data); err != nil {
+			log.Printf("web: failed to encode %v: %v", r.URL.Path, err)
+		}
+	})
+}
+
+// checkMethod only allows GET/HEAD requests since the server is read-only.
+func checkMethod(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if _, ok := err.(*clientutil.NotFoundError); ok || err == errNotFound {
+		status = http.StatusNotFound
+	}
+	if status == http.StatusInternalServerError {
+		log.Printf("web: %v", err)
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// Host holds the snapsets of a host (latest version of each, sorted by path).
+type Host struct {
+	Hostname string               `json:"hostname"`
+	SnapSets []*snapshot.Snapshot `json:"snapsets"`
+}
+
+// SnapSet holds the versions of a snapset (most recent first).
+type SnapSet struct {
+	Key      string               `json:"key"`
+	Path     string               `json:"path"`
+	Hostname string               `json:"hostname"`
+	Versions []*snapshot.Snapshot `json:"versions"`
+}
+
+// Entry is a file/directory of a snapshot.
+type Entry struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Size    int    `json:"size"`
+	Mode    string `json:"mode"`
+	ModTime string `json:"mtime"`
+	Ref     string `json:"ref"`
+}
+
+// Listing is the file/directory located at Path in the snapshot Ref (with its content if it's a directory).
+type Listing struct {
+	Ref     string   `json:"ref"`
+	Path    string   `json:"path"`
+	Entry   *Entry   `json:"entry"`
+	Entries []*Entry `json:"entries,omitempty"`
+}
+
+// Crumb is a parent directory of the listing.
+type Crumb struct {
+	Name string
+	Path string
+}
+
+// Crumbs returns the parent directories of the listing, from the root of the snapshot.
+func (l *Listing) Crumbs() []*Crumb {
+	crumbs := []*Crumb{{Name: "/"}}
+	p := ""
+	for _, name := range strings.Split(l.Path, "/") {
+		if name == "" {
+			continue
+		}
+		p = path.Join(p, name)
+		crumbs = append(crumbs, &Crumb{Name: name, Path: p})
+	}
+	return crumbs
+}
+
+func newEntry(meta *clientutil.Meta) *Entry {
+	return &Entry{
+		Name:    meta.Name,
+		Type:    meta.Type,
+		Size:    meta.Size,
+		Mode:    os.FileMode(meta.Mode).String(),
+		ModTime: meta.ModTime,
+		Ref:     meta.Hash,
+	}
+}
+
+// hostSnapSets returns the hosts and their snapsets, sorted by hostname.
+func (s *Server) hostSnapSets() ([]*Host, error) {
+	snaps, err := snapshot.SnapSets(s.kvs)
+	if err != nil {
+		return nil, err
+	}
+	index := map[string]*Host{}
+	hosts := []*Host{}
+	for _, snap := range snaps {
+		host, ok := index[snap.Hostname]
+		if !ok {
+			host = &Host{Hostname: snap.Hostname, SnapSets: []*snapshot.Snapshot{}}
+			index[snap.Hostname] = host
+			hosts = append(hosts, host)
+		}
+		host.SnapSets = append(host.SnapSets, snap)
+	}
+	sort.Sort(byHostname(hosts))
+	for _, host := range hosts {
+		sort.Sort(byPath(host.SnapSets))
+	}
+	return hosts, nil
+}
+
+type byHostname []*Host
+
+func (h byHostname) Len() int           { return len(h) }
+func (h byHostname) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h byHostname) Less(i, j int) bool { return h[i].Hostname < h[j].Hostname }
+
+type byPath []*snapshot.Snapshot
+
+func (s byPath) Len() int           { return len(s) }
+func (s byPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byPath) Less(i, j int) bool { return s[i].Path < s[j].Path }
+
+func (s *Server) hosts(p string) (interface{}, error) {
+	if p != "" {
+		return nil, errNotFound
+	}
+	return s.hostSnapSets()
+}
+
+func (s *Server) host(p string) (interface{}, error) {
+	hosts, err := s.hostSnapSets()
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		if host.Hostname == p {
+			return host, nil
+		}
+	}
+	return nil, errNotFound
+}
+
+func (s *Server) snapset(key string) (interface{}, error) {
+	if key == "" || strings.Contains(key, "/") {
+		return nil, errNotFound
+	}
+	snaps, err := snapshot.Versions(s.kvs, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(snaps) == 0 {
+		return nil, errNotFound
+	}
+	// Most recent first
+	versions := make([]*snapshot.Snapshot, len(snaps))
+	for i, snap := range snaps {
+		versions[len(snaps)-1-i] = snap
+	}
+	return &SnapSet{
+		Key:      key,
+		Path:     versions[0].Path,
+		Hostname: versions[0].Hostname,
+		Versions: versions,
+	}, nil
+}
+
+// splitRef splits "{ref}/{path}" into the ref and the cleaned path relative to its root ("" for the root).
+func splitRef(p string) (string, string, error) {
+	parts := strings.SplitN(p, "/", 2)
+	if parts[0] == "" {
+		return "", "", errNotFound
+	}
+	rpath := ""
+	if len(parts) == 2 {
+		rpath = strings.TrimPrefix(path.Clean("/"+parts[1]), "/")
+	}
+	return parts[0], rpath, nil
+}
+
+// lookup returns the Meta located at "{ref}/{path}".
+func (s *Server) lookup(p string) (string, string, *clientutil.Meta, error) {
+	ref, rpath, err := splitRef(p)
+	if err != nil {
+		return "", "", nil, err
+	}
+	meta, err := clientutil.Lookup(s.bs, ref, rpath)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return ref, rpath, meta, nil
+}
+
+func (s *Server) browse(p string) (interface{}, error) {
+	ref, rpath, meta, err := s.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	l := &Listing{Ref: ref, Path: rpath, Entry: newEntry(meta)}
+	if meta.IsDir() {
+		l.Entries = []*Entry{}
+		for _, cref := range meta.Refs {
+			hash, ok := cref.(string)
+			if !ok {
+				return nil, fmt.Errorf("dir %v (%v): unexpected ref %v", meta.Name, meta.Hash, cref)
+			}
+			cmeta, err := clientutil.NewMetaFromBlobStore(s.bs, hash)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch meta: %v", err)
+			}
+			l.Entries = append(l.Entries, newEntry(cmeta))
+		}
+	}
+	return l, nil
+}
+
+// archiveTypes maps the archive formats to their content type.
+var archiveTypes = map[string]string{
+	clientutil.FormatZip:   "application/zip",
+	clientutil.FormatTar:   "application/x-tar",
+	clientutil.FormatTarGz: "application/gzip",
+}
+
+// download serves the file located at "/download/{ref}/{path}", or the directory as an archive.
+func (s *Server) download(w http.ResponseWriter, r *http.Request) {
+	if !checkMethod(w, r) {
+		return
+	}
+	_, _, meta, err := s.lookup(strings.TrimPrefix(r.URL.Path, "/download/"))
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if meta.IsFile() {
+		ffile, err := clientutil.NewFakeFile(s.bs, meta)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		defer ffile.Close()
+		serveFile(w, r, meta, ffile)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = clientutil.FormatZip
+	}
+	ctype, ok := archiveTypes[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unsupported archive format %q (tar, tar.gz or zip)", format), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Disposition", attachment(meta.Name+"."+format))
+	if r.Method == "HEAD" {
+		return
+	}
+	// The archive is streamed, an error can't be reported once the response started
+	if _, err := clientutil.Export(s.bs, meta.Hash, w, format); err != nil {
+		log.Printf("web: failed to export %v: %v", r.URL.Path, err)
+	}
+}
+
+// serveFile serves the content of the file, with Range and conditional requests support.
+func serveFile(w http.ResponseWriter, r *http.Request, meta *clientutil.Meta, ra io.ReaderAt) {
+	mtime, _ := time.Parse(time.RFC3339, meta.ModTime)
+	http.ServeContent(w, r, meta.Name, mtime, io.NewSectionReader(ra, 0, int64(meta.Size)))
+}
+
+// attachment returns the Content-Disposition header value to download the file as name.
+func attachment(name string) string {
+	if v := mime.FormatMediaType("attachment", map[string]string{"filename": name}); v != "" {
+		return v
+	}
+	// Names not representable in the header are left to the browser
+	return "attachment"
+}
@@ -0,0 +1,117 @@
+package web
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tsileo/blobsnap/clientutil"
+	"github.com/tsileo/blobsnap/snapshot"
+)
+
+func TestSplitRef(t *testing.T) {
+	for p, expected := range map[string][2]string{
+		"abcd":             {"abcd", ""},
+		"abcd/":            {"abcd", ""},
+		"abcd/etc/hosts":   {"abcd", "etc/hosts"},
+		"abcd//etc/./a/":   {"abcd", "etc/a"},
+		"abcd/../../etc/a": {"abcd", "etc/a"},
+	} {
+		ref, rpath, err := splitRef(p)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", p, err)
+			continue
+		}
+		if ref != expected[0] || rpath != expected[1] {
+			t.Errorf("%q: got (%q, %q), expected (%q, %q)", p, ref, rpath, expected[0], expected[1])
+		}
+	}
+	if _, _, err := splitRef("/etc"); err != errNotFound {
+		t.Errorf("missing ref should be not found, got %v", err)
+	}
+}
+
+func TestListingCrumbs(t *testing.T) {
+	l := &Listing{Ref: "abcd", Path: "home/thomas/.bashrc"}
+	expected := []Crumb{{"/", ""}, {"home", "home"}, {"thomas", "home/thomas"}, {".bashrc", "home/thomas/.bashrc"}}
+	crumbs := l.Crumbs()
+	if len(crumbs) != len(expected) {
+		t.Fatalf("got %d crumbs, expected %d", len(crumbs), len(expected))
+	}
+	for i, crumb := range crumbs {
+		if *crumb != expected[i] {
+			t.Errorf("crumb %d: got %+v, expected %+v", i, crumb, expected[i])
+		}
+	}
+}
+
+func TestServeFileRange(t *testing.T) {
+	// A file made of a single hole can be read without a blob store
+	meta := &clientutil.Meta{Name: "disk.img", Type: "file", Size: 1 << 20, Mode: 0644,
+		ModTime: time.Date(2015, 5, 12, 17, 25, 47, 0, time.UTC).Format(time.RFC3339)}
+	meta.AddHole(meta.Size)
+	ffile, err := clientutil.NewFakeFile(nil, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", "/download/abcd/disk.img", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=1000-1999")
+	w := httptest.NewRecorder()
+	serveFile(w, req, meta, ffile)
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("status %d, expected %d", w.Code, http.StatusPartialContent)
+	}
+	if cr := w.Header().Get("Content-Range"); cr != "bytes 1000-1999/1048576" {
+		t.Errorf("Content-Range %q", cr)
+	}
+	if lm := w.Header().Get("Last-Modified"); lm != "Tue, 12 May 2015 17:25:47 GMT" {
+		t.Errorf("Last-Modified %q", lm)
+	}
+	if !bytes.Equal(w.Body.Bytes(), make([]byte, 1000)) {
+		t.Errorf("unexpected content (%d bytes)", w.Body.Len())
+	}
+
+	req.Header.Del("Range")
+	w = httptest.NewRecorder()
+	serveFile(w, req, meta, ffile)
+	body, _ := ioutil.ReadAll(w.Body)
+	if w.Code != http.StatusOK || len(body) != meta.Size {
+		t.Errorf("status %d, %d bytes, expected %d bytes", w.Code, len(body), meta.Size)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	snap := &snapshot.Snapshot{Path: "/home/thomas", Hostname: "tomt0m", Ref: "abcd", Time: 1431451547,
+		SnapSetKey: "efgh", WriteResult: clientutil.NewWriteResult()}
+	for tmpl, data := range map[string]interface{}{
+		"hosts":   []*Host{{Hostname: "tomt0m", SnapSets: []*snapshot.Snapshot{snap}}},
+		"host":    &Host{Hostname: "tomt0m", SnapSets: []*snapshot.Snapshot{snap}},
+		"snapset": &SnapSet{Key: "efgh", Path: snap.Path, Hostname: snap.Hostname, Versions: []*snapshot.Snapshot{snap}},
+		"browse": &Listing{Ref: "abcd", Path: "my docs", Entry: &Entry{Name: "my docs", Type: "dir"}, Entries: []*Entry{
+			{Name: "a?b#c.txt", Type: "file", Size: 2048},
+			{Name: "sub", Type: "dir"},
+		}},
+	} {
+		var buf bytes.Buffer
+		if err := templates.ExecuteTemplate(&buf, tmpl, data); err != nil {
+			t.Errorf("%v: %v", tmpl, err)
+			continue
+		}
+		if tmpl == "browse" {
+			out := buf.String()
+			for _, link := range []string{`href="/browse/abcd/my%20docs/a%3Fb%23c.txt"`, `href="/browse/abcd/my%20docs/sub/"`,
+				`href="/download/abcd/my%20docs?format=zip"`} {
+				if !strings.Contains(out, link) {
+					t.Errorf("browse: missing %v", link)
+				}
+			}
+		}
+	}
+}